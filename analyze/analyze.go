@@ -7,11 +7,13 @@ import (
 
 type analyzer struct {
 	duckdb *db.DuckDB
+	// sampled is set when counts are estimates scaled up from a sampled tape
+	sampled bool
 }
 
-func newAnalyzer(mm bool) (*analyzer, error) {
+func newAnalyzer(dir string, mm bool, servers []string) (*analyzer, error) {
 
-	option, err := o.GetOption()
+	option, err := o.GetOption(dir)
 	if err != nil {
 		return nil, err
 	}
@@ -19,13 +21,28 @@ func newAnalyzer(mm bool) (*analyzer, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = duckdb.KeepServers(servers)
+	if err != nil {
+		return nil, err
+	}
+	sampling, err := loadSampling(option[0])
+	if err != nil {
+		return nil, err
+	}
+	if sampling != nil {
+		err = sampling.scale(duckdb)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return &analyzer{
-		duckdb: duckdb,
+		duckdb:  duckdb,
+		sampled: sampling != nil,
 	}, nil
 }
 
 func (a *analyzer) run() error {
-	r := newReport(a.duckdb)
+	r := newReport(a.duckdb, a.sampled)
 	r.render()
 	return nil
 }
@@ -11,9 +11,18 @@ var Commands = &cli.Command{
 			Name:  "memory",
 			Usage: "enables duckdb in-memory mode",
 		},
+		&cli.StringSliceFlag{
+			Name:  "server",
+			Usage: "only analyze queries sent to this host:port, repeat for several servers",
+		},
+		&cli.StringFlag{
+			Name:  "dir",
+			Value: ".",
+			Usage: "directory to look for tapes in",
+		},
 	},
 	Action: func(context *cli.Context) error {
-		a, err := newAnalyzer(context.Bool("memory"))
+		a, err := newAnalyzer(context.String("dir"), context.Bool("memory"), context.StringSlice("server"))
 		if err != nil {
 			return err
 		}
@@ -16,19 +16,29 @@ import (
 
 type report struct {
 	db                    *db.DuckDB
+	sampled               bool
 	timeRange             string
 	totalQueriesCount     string
-	queryTypeDistribution queryTypeDistribution
+	queryTypeDistribution []queryType
 	highFrequencyQueries  []highFrequencyQueries
+	slowQueries           []slowQueries
+	plans                 []plans
+	clients               []clients
+	servers               []servers
 }
 
-func newReport(duckdb *db.DuckDB) *report {
+func newReport(duckdb *db.DuckDB, sampled bool) *report {
 	r := &report{}
 	r.db = duckdb
+	r.sampled = sampled
 	r.getTimeRange()
 	r.getTotalQueriesCount()
 	r.getQueryTypeDistribution()
 	r.getHighFrequencyQueries()
+	r.getSlowQueries()
+	r.getPlans()
+	r.getClients()
+	r.getServers()
 	return r
 }
 
@@ -41,26 +51,23 @@ func (r *report) render() {
 	tb.SetTitle("📊 Workload Analysis Report")
 	tb.AppendRow(
 		table.Row{r.timeRange})
+	if r.sampled {
+		tb.AppendRow(
+			table.Row{"counts are estimates scaled up from a sampled tape"})
+	}
 	l.AppendItem(tb.Render())
 
 	tb = table.NewWriter()
 	tb.SetStyle(table.StyleLight)
 	tb.SetTitle("🌧️ Query Type Distribution")
-	tb.AppendRow(
-		table.Row{
-			"TOTAL", "SELECT", "INSERT", "UPDATE", "DELETE", "COMMIT", "ROLLBACK", "DDL", "ANALYZE", "UNKNOWN"})
-	tb.AppendRow(
-		table.Row{
-			r.totalQueriesCount,
-			r.queryTypeDistribution.SELECT.Percent,
-			r.queryTypeDistribution.INSERT.Percent,
-			r.queryTypeDistribution.UPDATE.Percent,
-			r.queryTypeDistribution.DELETE.Percent,
-			r.queryTypeDistribution.COMMIT.Percent,
-			r.queryTypeDistribution.ROLLBACK.Percent,
-			r.queryTypeDistribution.DDL.Percent,
-			r.queryTypeDistribution.ANALYZE.Percent,
-			r.queryTypeDistribution.UNKNOWN.Percent})
+	header := table.Row{"TOTAL"}
+	row := table.Row{r.totalQueriesCount}
+	for _, q := range r.queryTypeDistribution {
+		header = append(header, strings.ToUpper(q.Type))
+		row = append(row, q.Percent)
+	}
+	tb.AppendRow(header)
+	tb.AppendRow(row)
 	l.AppendItem(tb.Render())
 	l.UnIndent()
 
@@ -75,6 +82,53 @@ func (r *report) render() {
 	l.AppendItem(tb.Render())
 	l.UnIndent()
 
+	tb = table.NewWriter()
+	tb.SetStyle(table.StyleLight)
+	tb.SetTitle("🐢 Slow queries")
+	tb.AppendHeader(table.Row{"Query", "Count", "Avg (ms)", "Max (ms)", "Rows", "Errors"})
+	for _, row := range r.slowQueries {
+		tb.AppendRow(
+			table.Row{row.text, row.count, row.avg, row.max, row.rows, row.errors})
+	}
+	l.AppendItem(tb.Render())
+	l.UnIndent()
+
+	// only tapes imported from the TiDB slow log know their plans
+	if len(r.plans) > 0 {
+		tb = table.NewWriter()
+		tb.SetStyle(table.StyleLight)
+		tb.SetTitle("🧭 Plans")
+		tb.AppendHeader(table.Row{"Query", "Plan digest", "Count", "Avg (ms)", "Process keys", "Rows"})
+		for _, row := range r.plans {
+			tb.AppendRow(
+				table.Row{row.text, row.digest, row.count, row.avg, row.keys, row.rows})
+		}
+		l.AppendItem(tb.Render())
+		l.UnIndent()
+	}
+
+	tb = table.NewWriter()
+	tb.SetStyle(table.StyleLight)
+	tb.SetTitle("👥 Clients")
+	tb.AppendHeader(table.Row{"User", "Program", "Client", "Count"})
+	for _, row := range r.clients {
+		tb.AppendRow(
+			table.Row{row.user, row.program, row.client, row.count})
+	}
+	l.AppendItem(tb.Render())
+	l.UnIndent()
+
+	tb = table.NewWriter()
+	tb.SetStyle(table.StyleLight)
+	tb.SetTitle("🖥️ Servers")
+	tb.AppendHeader(table.Row{"Server", "Protocol", "Count", "Connections", "Avg (ms)"})
+	for _, row := range r.servers {
+		tb.AppendRow(
+			table.Row{row.server, row.protocol, row.count, row.conns, row.avg})
+	}
+	l.AppendItem(tb.Render())
+	l.UnIndent()
+
 	fmt.Println(l.Render())
 }
 
@@ -91,7 +145,7 @@ func (r *report) getTimeRange() {
 }
 
 func (r *report) getTotalQueriesCount() {
-	query := fmt.Sprintf(`SELECT COUNT(*) FROM %s`, db.TableName)
+	query := fmt.Sprintf(`SELECT CAST(ROUND(COALESCE(SUM(weight), 0)) AS BIGINT) FROM %s`, db.TableName)
 	var count string
 	err := r.db.Conn.QueryRow(query).Scan(&count)
 	if err != nil {
@@ -101,74 +155,33 @@ func (r *report) getTotalQueriesCount() {
 }
 
 type queryType struct {
+	Type    string `json:"type"`
 	Count   int64  `json:"count"`
 	Percent string `json:"percent"`
 }
 
-type queryTypeDistribution struct {
-	SELECT   queryType `json:"select"`
-	INSERT   queryType `json:"insert"`
-	UPDATE   queryType `json:"update"`
-	DELETE   queryType `json:"delete"`
-	COMMIT   queryType `json:"commit"`
-	ROLLBACK queryType `json:"rollback"`
-	DDL      queryType `json:"ddl"`
-	ANALYZE  queryType `json:"analyze"`
-	UNKNOWN  queryType `json:"unknown"`
-}
-
+// getQueryTypeDistribution counts every type found on the tape, most
+// frequent first.
 func (r *report) getQueryTypeDistribution() {
-	sql := fmt.Sprintf(`WITH type_counts AS (
-		SELECT TYPE, COUNT(*) as count FROM %s GROUP BY TYPE
-	),
-	total_count AS (
-		SELECT COUNT(*) as total FROM %s
-	)
-	SELECT
-		COALESCE(SUM(CASE WHEN TYPE = 'select' THEN count END), 0) AS select_count,
-		CONCAT(COALESCE(SUM(CASE WHEN TYPE = 'select' THEN count END), 0), ' (', ROUND(COALESCE(SUM(CASE WHEN TYPE = 'select' THEN count END), 0) * 100.0 / ANY_VALUE(total), 3), '%%', ')') AS select_percent,
-		COALESCE(SUM(CASE WHEN TYPE = 'insert' THEN count END), 0) AS insert_count,
-		CONCAT(COALESCE(SUM(CASE WHEN TYPE = 'insert' THEN count END), 0), ' (', ROUND(COALESCE(SUM(CASE WHEN TYPE = 'insert' THEN count END), 0) * 100.0 / ANY_VALUE(total), 3), '%%', ')') AS insert_percent,
-		COALESCE(SUM(CASE WHEN TYPE = 'update' THEN count END), 0) AS update_count,
-		CONCAT(COALESCE(SUM(CASE WHEN TYPE = 'update' THEN count END), 0), ' (', ROUND(COALESCE(SUM(CASE WHEN TYPE = 'update' THEN count END), 0) * 100.0 / ANY_VALUE(total), 3), '%%', ')') AS update_percent,
-		COALESCE(SUM(CASE WHEN TYPE = 'delete' THEN count END), 0) AS delete_count,
-		CONCAT(COALESCE(SUM(CASE WHEN TYPE = 'delete' THEN count END), 0), ' (', ROUND(COALESCE(SUM(CASE WHEN TYPE = 'delete' THEN count END), 0) * 100.0 / ANY_VALUE(total), 3), '%%', ')') AS delete_percent,
-		COALESCE(SUM(CASE WHEN TYPE = 'commit' THEN count END), 0) AS commit_count,
-		CONCAT(COALESCE(SUM(CASE WHEN TYPE = 'commit' THEN count END), 0), ' (', ROUND(COALESCE(SUM(CASE WHEN TYPE = 'commit' THEN count END), 0) * 100.0 / ANY_VALUE(total), 3), '%%', ')') AS commit_percent,
-		COALESCE(SUM(CASE WHEN TYPE = 'rollback' THEN count END), 0) AS rollback_count,
-		CONCAT(COALESCE(SUM(CASE WHEN TYPE = 'rollback' THEN count END), 0), ' (', ROUND(COALESCE(SUM(CASE WHEN TYPE = 'rollback' THEN count END), 0) * 100.0 / ANY_VALUE(total), 3), '%%', ')') AS rollback_percent,
-		COALESCE(SUM(CASE WHEN TYPE = 'ddl' THEN count END), 0) AS ddl_count,
-		CONCAT(COALESCE(SUM(CASE WHEN TYPE = 'ddl' THEN count END), 0), ' (', ROUND(COALESCE(SUM(CASE WHEN TYPE = 'ddl' THEN count END), 0) * 100.0 / ANY_VALUE(total), 3), '%%', ')') AS ddl_percent,
-		COALESCE(SUM(CASE WHEN TYPE = 'analyze' THEN count END), 0) AS analyze_count,
-		CONCAT(COALESCE(SUM(CASE WHEN TYPE = 'analyze' THEN count END), 0), ' (', ROUND(COALESCE(SUM(CASE WHEN TYPE = 'analyze' THEN count END), 0) * 100.0 / ANY_VALUE(total), 3), '%%', ')') AS analyze_percent,
-		COALESCE(SUM(CASE WHEN TYPE = 'unknown' THEN count END), 0) AS unknown_count,
-		CONCAT(COALESCE(SUM(CASE WHEN TYPE = 'unknown' THEN count END), 0), ' (', ROUND(COALESCE(SUM(CASE WHEN TYPE = 'unknown' THEN count END), 0) * 100.0 / ANY_VALUE(total), 3), '%%', ')') AS unknown_percent
-	FROM type_counts, total_count`, db.TableName, db.TableName)
-
-	rs, err := r.db.Conn.Query(sql)
+	query := fmt.Sprintf(`SELECT COALESCE(type, 'unknown'), CAST(ROUND(SUM(weight)) AS BIGINT),
+		CONCAT(CAST(ROUND(SUM(weight)) AS BIGINT), ' (', ROUND(SUM(weight) * 100.0 / SUM(SUM(weight)) OVER (), 3), '%%', ')')
+	FROM %s GROUP BY ALL ORDER BY SUM(weight) DESC`, db.TableName)
+
+	rs, err := r.db.Conn.Query(query)
 	if err != nil {
 		log.Fatal("failed to get SQL-type-distribution", zap.Error(err))
 	}
 	defer rs.Close()
 
-	var q queryTypeDistribution
-	if rs.Next() {
-		err := rs.Scan(
-			&q.SELECT.Count, &q.SELECT.Percent,
-			&q.INSERT.Count, &q.INSERT.Percent,
-			&q.UPDATE.Count, &q.UPDATE.Percent,
-			&q.DELETE.Count, &q.DELETE.Percent,
-			&q.COMMIT.Count, &q.COMMIT.Percent,
-			&q.ROLLBACK.Count, &q.ROLLBACK.Percent,
-			&q.DDL.Count, &q.DDL.Percent,
-			&q.ANALYZE.Count, &q.ANALYZE.Percent,
-			&q.UNKNOWN.Count, &q.UNKNOWN.Percent,
-		)
-		if err != nil {
+	qs := make([]queryType, 0)
+	for rs.Next() {
+		q := queryType{}
+		if err := rs.Scan(&q.Type, &q.Count, &q.Percent); err != nil {
 			log.Fatal("failed to get SQL-type-distribution", zap.Error(err))
 		}
+		qs = append(qs, q)
 	}
-	r.queryTypeDistribution = q
+	r.queryTypeDistribution = qs
 }
 
 type highFrequencyQueries struct {
@@ -178,7 +191,7 @@ type highFrequencyQueries struct {
 
 func (r *report) getHighFrequencyQueries() {
 
-	query := fmt.Sprintf(`SELECT FIRST(text), COUNT(*) AS count FROM %s GROUP BY digest ORDER BY COUNT(*) DESC LIMIT 20`, db.TableName)
+	query := fmt.Sprintf(`SELECT FIRST(text), CAST(ROUND(SUM(weight)) AS BIGINT) AS count FROM %s GROUP BY digest ORDER BY SUM(weight) DESC LIMIT 20`, db.TableName)
 
 	rs, err := r.db.Conn.Query(query)
 	if err != nil {
@@ -246,3 +259,138 @@ func verb(str string) string {
 	}
 	return compressed[:m] + "..."
 }
+
+type slowQueries struct {
+	text   string
+	count  int
+	avg    float64
+	max    float64
+	rows   int64
+	errors int
+}
+
+func (r *report) getSlowQueries() {
+
+	query := fmt.Sprintf(`SELECT FIRST(text), CAST(ROUND(SUM(weight)) AS BIGINT),
+		ROUND(AVG(response_time) / 1000, 3), ROUND(MAX(response_time) / 1000, 3),
+		CAST(ROUND(SUM(returned_rows * weight)) AS BIGINT), CAST(ROUND(COALESCE(SUM(weight) FILTER (WHERE error_code > 0), 0)) AS BIGINT)
+	FROM %s WHERE response_time > 0 GROUP BY digest ORDER BY AVG(response_time) DESC LIMIT 20`, db.TableName)
+
+	rs, err := r.db.Conn.Query(query)
+	if err != nil {
+		log.Fatal("failed to set slow-queries", zap.Error(err))
+	}
+	defer func(rs *sql.Rows) {
+		_ = rs.Close()
+	}(rs)
+	ss := make([]slowQueries, 0)
+	for rs.Next() {
+		s := slowQueries{}
+		if err := rs.Scan(&s.text, &s.count, &s.avg, &s.max, &s.rows, &s.errors); err != nil {
+			log.Fatal("failed to set slow-queries", zap.Error(err))
+		}
+		s.text = verb(parser.NormalizeForBinding(s.text, false))
+		ss = append(ss, s)
+	}
+	r.slowQueries = ss
+}
+
+type plans struct {
+	text   string
+	digest string
+	count  int
+	avg    float64
+	keys   int64
+	rows   int64
+}
+
+// getPlans ranks the plans of every query by the keys they processed, the
+// plan digest is cut short to fit.
+func (r *report) getPlans() {
+
+	query := fmt.Sprintf(`SELECT FIRST(text), LEFT(plan_digest, 16), CAST(ROUND(SUM(weight)) AS BIGINT),
+		ROUND(AVG(response_time) / 1000, 3), CAST(ROUND(COALESCE(SUM(process_keys * weight), 0)) AS BIGINT),
+		CAST(ROUND(SUM(returned_rows * weight)) AS BIGINT)
+	FROM %s WHERE plan_digest <> '' GROUP BY digest, plan_digest
+	ORDER BY COALESCE(SUM(process_keys * weight), 0) DESC, AVG(response_time) DESC LIMIT 20`, db.TableName)
+
+	rs, err := r.db.Conn.Query(query)
+	if err != nil {
+		log.Fatal("failed to set plans", zap.Error(err))
+	}
+	defer func(rs *sql.Rows) {
+		_ = rs.Close()
+	}(rs)
+	ps := make([]plans, 0)
+	for rs.Next() {
+		p := plans{}
+		if err := rs.Scan(&p.text, &p.digest, &p.count, &p.avg, &p.keys, &p.rows); err != nil {
+			log.Fatal("failed to set plans", zap.Error(err))
+		}
+		p.text = verb(parser.NormalizeForBinding(p.text, false))
+		ps = append(ps, p)
+	}
+	r.plans = ps
+}
+
+type clients struct {
+	user    string
+	program string
+	client  string
+	count   int
+}
+
+func (r *report) getClients() {
+
+	query := fmt.Sprintf(`SELECT COALESCE("user", ''), COALESCE(attrs['program_name'], attrs['application_name'], ''), COALESCE(attrs['_client_name'], ''), CAST(ROUND(SUM(weight)) AS BIGINT)
+	FROM %s GROUP BY ALL ORDER BY SUM(weight) DESC LIMIT 20`, db.TableName)
+
+	rs, err := r.db.Conn.Query(query)
+	if err != nil {
+		log.Fatal("failed to set clients", zap.Error(err))
+	}
+	defer func(rs *sql.Rows) {
+		_ = rs.Close()
+	}(rs)
+	cs := make([]clients, 0)
+	for rs.Next() {
+		c := clients{}
+		if err := rs.Scan(&c.user, &c.program, &c.client, &c.count); err != nil {
+			log.Fatal("failed to set clients", zap.Error(err))
+		}
+		cs = append(cs, c)
+	}
+	r.clients = cs
+}
+
+type servers struct {
+	server   string
+	protocol string
+	count    int
+	conns    int
+	avg      float64
+}
+
+func (r *report) getServers() {
+
+	query := fmt.Sprintf(`SELECT COALESCE(server, ''), COALESCE(protocol, 'mysql'), CAST(ROUND(SUM(weight)) AS BIGINT), COUNT(DISTINCT conn),
+		COALESCE(ROUND(AVG(response_time) FILTER (WHERE response_time > 0) / 1000, 3), 0)
+	FROM %s GROUP BY ALL ORDER BY SUM(weight) DESC`, db.TableName)
+
+	rs, err := r.db.Conn.Query(query)
+	if err != nil {
+		log.Fatal("failed to set servers", zap.Error(err))
+	}
+	defer func(rs *sql.Rows) {
+		_ = rs.Close()
+	}(rs)
+	ss := make([]servers, 0)
+	for rs.Next() {
+		s := servers{}
+		if err := rs.Scan(&s.server, &s.protocol, &s.count, &s.conns, &s.avg); err != nil {
+			log.Fatal("failed to set servers", zap.Error(err))
+		}
+		ss = append(ss, s)
+	}
+	r.servers = ss
+}
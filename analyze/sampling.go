@@ -0,0 +1,54 @@
+package analyze
+
+import (
+	"cassette-tape/db"
+	o "cassette-tape/option"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const metaSuffix = ".meta"
+
+// sampling holds the rates a tape was captured at, as capture writes them to
+// the .meta file.
+type sampling struct {
+	Conn    float64            `json:"conn"`
+	Types   map[string]float64 `json:"types"`
+	Digests map[string]struct {
+		Seen int64 `json:"seen"`
+		Kept int64 `json:"kept"`
+	} `json:"digests"`
+}
+
+// loadSampling reads the sampling rates of the tape file belongs to, nil when
+// the tape was not sampled or has no .meta file.
+func loadSampling(file string) (*sampling, error) {
+	data, err := os.ReadFile(o.Sidecar(file, metaSuffix))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read meta failed: %w", err)
+	}
+	var meta struct {
+		Sampling *sampling `json:"sampling"`
+	}
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		return nil, fmt.Errorf("parse meta failed: %w", err)
+	}
+	return meta.Sampling, nil
+}
+
+// scale makes every query count for the queries it stands for.
+func (s *sampling) scale(duckdb *db.DuckDB) error {
+	digests := make(map[string]float64)
+	for digest, count := range s.Digests {
+		if count.Kept > 0 {
+			digests[digest] = float64(count.Seen) / float64(count.Kept)
+		}
+	}
+	return duckdb.Scale(s.Conn, s.Types, digests)
+}
@@ -0,0 +1,221 @@
+package capture
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/reassembly"
+)
+
+const (
+	// out-of-order segments are buffered in pages of about 1900 bytes
+	maxBufferedPagesPerConn = 256
+	maxBufferedPagesTotal   = 65536
+
+	// gapTimeout is how long a gap may wait for retransmission before the
+	// data behind it is handed over and the gap counted as lost
+	gapTimeout    = 2 * time.Second
+	flushInterval = time.Second
+)
+
+func newAssembler(cm *connManager) *reassembly.Assembler {
+	assembler := reassembly.NewAssembler(reassembly.NewStreamPool(cm))
+	assembler.MaxBufferedPagesPerConnection = maxBufferedPagesPerConn
+	assembler.MaxBufferedPagesTotal = maxBufferedPagesTotal
+	return assembler
+}
+
+type captureContext gopacket.CaptureInfo
+
+func (c *captureContext) GetCaptureInfo() gopacket.CaptureInfo {
+	return gopacket.CaptureInfo(*c)
+}
+
+// networkFlow builds the flow the assembler keys connections by from the
+// folded addresses of networkAddresses.
+func networkFlow(src, dst net.IP) gopacket.Flow {
+	if len(src) == net.IPv4len && len(dst) == net.IPv4len {
+		return gopacket.NewFlow(layers.EndpointIPv4, src, dst)
+	}
+	return gopacket.NewFlow(layers.EndpointIPv6, src.To16(), dst.To16())
+}
+
+// tcpStream hands the reassembled bytes of one TCP connection to its conn.
+type tcpStream struct {
+	conn *conn
+	cm   *connManager
+	// netFlow is the network flow of the packet that opened the connection,
+	// the assembler direction client to server
+	netFlow gopacket.Flow
+	// requestDir is the assembler direction of the client to server half
+	requestDir reassembly.TCPFlowDirection
+	// seqs are the sequence numbers last seen in each direction
+	seqs     map[reassembly.TCPFlowDirection]uint32
+	closed   bool
+	complete bool
+	// reset is the RST closing the half that did not send the one the
+	// connection was reset by, resetFlow its network flow
+	reset     *layers.TCP
+	resetFlow gopacket.Flow
+	// dropped is set once a chunk found the queue of the conn full, the next
+	// one is marked lost so the conn resyncs
+	dropped bool
+}
+
+// New creates the conn of a TCP connection the assembler has not seen yet.
+// The packet that opened it may come from either side.
+func (cm *connManager) New(netFlow, _ gopacket.Flow, tcp *layers.TCP, _ reassembly.AssemblerContext) reassembly.Stream {
+	src, dst := netFlow.Endpoints()
+	clientIP, clientPort, serverIP, serverPort := src, tcp.SrcPort, dst, tcp.DstPort
+	requestDir := reassembly.TCPDirClientToServer
+	if cm.ports[int(tcp.DstPort)] == "" {
+		clientIP, clientPort, serverIP, serverPort = dst, tcp.DstPort, src, tcp.SrcPort
+		requestDir = reassembly.TCPDirServerToClient
+	}
+
+	from := net.JoinHostPort(net.IP(clientIP.Raw()).String(), strconv.Itoa(int(clientPort)))
+	server := net.JoinHostPort(net.IP(serverIP.Raw()).String(), strconv.Itoa(int(serverPort)))
+	if sampling != nil && !sampling.keepConn(from) {
+		SampledConnCount.Add(1)
+		return sampledOutStream{}
+	}
+	return &tcpStream{
+		conn:       cm.newConn(from, server, cm.ports[int(serverPort)]),
+		cm:         cm,
+		netFlow:    netFlow,
+		requestDir: requestDir,
+		seqs:       make(map[reassembly.TCPFlowDirection]uint32),
+	}
+}
+
+func (s *tcpStream) Accept(tcp *layers.TCP, _ gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, _ reassembly.Sequence, start *bool, _ reassembly.AssemblerContext) bool {
+	// connections established before the capture started have no SYN
+	*start = true
+	// the assembler only closes the half a RST was sent on, and would keep
+	// the flow, and every later connection on the same ports with it, until
+	// the other half is closed too. The conn is done with right away and the
+	// other half is reset once the packet is assembled.
+	if tcp.RST {
+		if !s.closed {
+			s.close()
+			s.reset = s.resetSegment(tcp, dir)
+			s.resetFlow = s.netFlow
+			if dir == reassembly.TCPDirClientToServer {
+				s.resetFlow = s.netFlow.Reverse()
+			}
+			s.cm.resets = append(s.cm.resets, s)
+		}
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.seqs[dir] = tcp.Seq
+	return true
+}
+
+// resetSegment builds a RST answering tcp, sent in direction dir. It is
+// decoded from its header since the assembler keys flows by the ports of
+// decoded segments. Its sequence number is the last one seen the other way,
+// which the assembler takes as in order.
+func (s *tcpStream) resetSegment(tcp *layers.TCP, dir reassembly.TCPFlowDirection) *layers.TCP {
+	header := make([]byte, 20)
+	binary.BigEndian.PutUint16(header, uint16(tcp.DstPort))
+	binary.BigEndian.PutUint16(header[2:], uint16(tcp.SrcPort))
+	binary.BigEndian.PutUint32(header[4:], s.seqs[dir.Reverse()])
+	// a header of 5 words with only RST set
+	header[12] = 5 << 4
+	header[13] = 0x04
+	reset := &layers.TCP{}
+	_ = reset.DecodeFromBytes(header, gopacket.NilDecodeFeedback)
+	return reset
+}
+
+// resetFlows closes the other half of the connections reset by the packet
+// just assembled, so the assembler drops their flows.
+func (c *capture) resetFlows(ci *captureContext) {
+	for _, s := range c.connManager.resets {
+		// the RST closed the last half open
+		if s.complete {
+			continue
+		}
+		c.assembler.AssembleWithContext(s.resetFlow, s.reset, ci)
+	}
+	clear(c.connManager.resets)
+	c.connManager.resets = c.connManager.resets[:0]
+}
+
+func (s *tcpStream) ReassembledSG(sg reassembly.ScatterGather, _ reassembly.AssemblerContext) {
+	if s.closed {
+		return
+	}
+	length, _ := sg.Lengths()
+	dir, _, _, skip := sg.Info()
+	TotalOutOrderCount.Add(int32(sg.Stats().QueuedPackets))
+	// a negative skip only means the start of the stream was not seen
+	lost := skip > 0
+	if lost {
+		TotalLostPacketCount.Add(1)
+	}
+	if length == 0 && !lost {
+		return
+	}
+
+	p := &packet{
+		payload:  make([]byte, length),
+		response: dir != s.requestDir,
+		lost:     lost || s.dropped,
+	}
+	copy(p.payload, sg.Fetch(length))
+	if length > 0 {
+		p.timestamp = sg.CaptureInfo(0).Timestamp
+	}
+	if !lossy {
+		s.conn.packetChan <- p
+		return
+	}
+	// a slow conn loses its own bytes rather than hold up every other one
+	select {
+	case s.conn.packetChan <- p:
+		s.dropped = false
+	default:
+		DroppedChunkCount.Add(1)
+		s.dropped = true
+	}
+}
+
+// ReassemblyComplete is called once both halves are closed by FIN, or after
+// the flow has been idle for too long.
+func (s *tcpStream) ReassemblyComplete(_ reassembly.AssemblerContext) bool {
+	s.close()
+	s.complete = true
+	return true
+}
+
+// close lets the conn finish the packets it has and exit, nothing is sent to
+// it afterwards.
+func (s *tcpStream) close() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.conn.packetChan)
+}
+
+// sampledOutStream ignores a connection left out by sampling, which the
+// assembler drops once it has been idle for long enough.
+type sampledOutStream struct{}
+
+func (sampledOutStream) Accept(*layers.TCP, gopacket.CaptureInfo, reassembly.TCPFlowDirection, reassembly.Sequence, *bool, reassembly.AssemblerContext) bool {
+	return false
+}
+
+func (sampledOutStream) ReassembledSG(reassembly.ScatterGather, reassembly.AssemblerContext) {}
+
+func (sampledOutStream) ReassemblyComplete(reassembly.AssemblerContext) bool {
+	return true
+}
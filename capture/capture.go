@@ -1,16 +1,19 @@
 package capture
 
 import (
-	"bufio"
 	"fmt"
-	"net"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/reassembly"
 	"github.com/pingcap/log"
 	"go.uber.org/zap"
 )
@@ -18,39 +21,89 @@ import (
 const (
 	snaplen = 65535
 	promisc = true
-	fName   = "Queries_%s.json"
+	// packetQueueSize bounds the packets read off the devices that wait for
+	// the assembler
+	packetQueueSize = 4096
 )
 
-var fileName string
+// lossy is set for live captures. Their queues drop what they can't take
+// rather than stall the pcap reader, which would leave the kernel to drop
+// packets unseen. Files, the proxy and imports wait instead and lose nothing.
+var lossy bool
 
 type capture struct {
-	device       string
-	port         int
-	packetSource *gopacket.PacketSource
-	connManager  *connManager
-	packetPool   sync.Pool
+	devices     []string
+	ports       map[int]string
+	pcapFile    string
+	bpf         string
+	idleTimeout time.Duration
+	duration    time.Duration
+	tape        TapeConfig
+	handles     []*pcap.Handle
+	packets     chan gopacket.Packet
+	connManager *connManager
+	assembler   *reassembly.Assembler
+	lastFlush   time.Time
 }
 
-func newCapture(device string, port int, level string) (*capture, error) {
+// captureConfig holds the flags of the capture command, sizes are in MB.
+type captureConfig struct {
+	devices      []string
+	ports        []int
+	pgPorts      []int
+	pcapFile     string
+	bpf          string
+	idleTimeout  time.Duration
+	duration     time.Duration
+	maxQueries   int
+	maxSize      int
+	maxQuerySize int
+	tape         TapeConfig
+	sampleConn   float64
+	sampleTypes  []string
+	sampleDigest int
+}
 
-	switch level {
-	case "info":
-		log.SetLevel(zap.InfoLevel)
-	case "debug":
-		log.SetLevel(zap.DebugLevel)
-	default:
-		log.SetLevel(zap.InfoLevel)
+func newCapture(cfg captureConfig) (*capture, error) {
+	if len(cfg.ports) == 0 && len(cfg.pgPorts) == 0 {
+		return nil, fmt.Errorf("at least one port is required")
+	}
+	err := checkLimits(
+		limit{duration, int64(cfg.duration)},
+		limit{maxQueries, int64(cfg.maxQueries)},
+		limit{maxSize, int64(cfg.maxSize)},
+		limit{maxQuerySize, int64(cfg.maxQuerySize)})
+	if err != nil {
+		return nil, err
+	}
+	queryLimit = cfg.maxQueries
+	lossy = cfg.pcapFile == ""
+	sizeLimit = int64(cfg.maxSize) * 1024 * 1024
+	sampling, err = newSampler(cfg.sampleConn, cfg.sampleTypes, cfg.sampleDigest)
+	if err != nil {
+		return nil, err
+	}
+
+	portSet := make(map[int]string)
+	for _, port := range cfg.ports {
+		portSet[port] = mysqlProtocol
+	}
+	for _, port := range cfg.pgPorts {
+		if portSet[port] == mysqlProtocol {
+			return nil, fmt.Errorf("port %d can't be both MySQL and PostgreSQL", port)
+		}
+		portSet[port] = postgresProtocol
 	}
 
 	return &capture{
-		device:      device,
-		port:        port,
-		connManager: newConnManager(),
-		packetPool: sync.Pool{
-			New: func() any {
-				return &packet{}
-			},
-		},
+		devices:     cfg.devices,
+		ports:       portSet,
+		pcapFile:    cfg.pcapFile,
+		bpf:         cfg.bpf,
+		idleTimeout: cfg.idleTimeout,
+		duration:    cfg.duration,
+		tape:        cfg.tape,
+		connManager: newConnManager(portSet, cfg.maxQuerySize*1024*1024),
 	}, nil
 }
 
@@ -61,74 +114,216 @@ func (c *capture) run() error {
 		return err
 	}
 
-	err = createWriteBuffer()
+	err = openTape(c.tape)
 	if err != nil {
-		return fmt.Errorf("create writeBuffer failed: %w", err)
+		return err
 	}
 
 	fmt.Println()
-	fmt.Printf("🚀 Starting capture queries on interface %s from port %d\n\n", c.device, c.port)
-	fmt.Println("⚠️ Prepare and execute can't be parsed, please set useServerPrepStmts=false")
+	if c.pcapFile != "" {
+		fmt.Printf("🚀 Starting capture queries from file %s with filter %s\n\n", c.pcapFile, c.filter())
+	} else {
+		fmt.Printf("🚀 Starting capture queries on interface %s with filter %s\n\n", strings.Join(c.devices, ", "), c.filter())
+	}
+	fmt.Println("⚠️ Statements prepared before the capture started can't be decoded")
 	fmt.Println("⚠️ Please turn off SSL mode, like --ssl-mode=disabled, useSSL=false")
 	fmt.Println()
 
-	for p := range c.packetSource.Packets() {
-
-		if p == nil {
-			continue
+	c.assembler = newAssembler(c.connManager)
+	if lossy {
+		pcapStats = c.pcapDrops
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	start := time.Now()
+	var deadline <-chan time.Time
+	if c.duration > 0 {
+		deadline = time.After(c.duration)
+	}
+loop:
+	for {
+		select {
+		case p, ok := <-c.packets:
+			if !ok {
+				break loop
+			}
+			c.handle(p)
+		case sig := <-signals:
+			// a second signal kills the process the usual way
+			signal.Stop(signals)
+			fmt.Printf("\n🛑 Received %s, stopping capture\n", sig)
+			break loop
+		case <-deadline:
+			fmt.Printf("\n⏱️ Captured for %s, stopping capture\n", c.duration)
+			break loop
+		case <-tapeFull:
+			fmt.Println("\n📦 Tape limit reached, stopping capture")
+			break loop
 		}
+	}
+	c.assembler.FlushAll()
+	c.connManager.close()
+	err = finish(start, c.connManager.globalID)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✅ Capture completed, queries written to %s\n", tape)
+	return nil
+}
 
-		tcpLayer := p.Layer(layers.LayerTypeTCP)
-		if tcpLayer == nil {
-			continue
-		}
-		tcp, _ := tcpLayer.(*layers.TCP)
+// finish closes the tape once every query is flushed and writes its summary.
+func finish(start time.Time, conns int) error {
+	err := closeWriteBuffer()
+	if err != nil {
+		return fmt.Errorf("close writeBuffer failed: %w", err)
+	}
+	err = closeDeadLetters()
+	if err != nil {
+		return fmt.Errorf("close dead letters failed: %w", err)
+	}
+	printStatistics()
+	s, err := newSummary(start, time.Now(), conns)
+	if err != nil {
+		return fmt.Errorf("create summary failed: %w", err)
+	}
+	s.print()
+	err = s.write()
+	if err != nil {
+		return fmt.Errorf("write summary failed: %w", err)
+	}
+	return nil
+}
 
-		ipLayer := p.Layer(layers.LayerTypeIPv4)
-		if ipLayer == nil {
-			continue
-		}
-		ip, _ := ipLayer.(*layers.IPv4)
-		if len(tcp.Payload) == 0 {
-			continue
-		}
+func setLevel(level string) {
+	switch level {
+	case "info":
+		log.SetLevel(zap.InfoLevel)
+	case "debug":
+		log.SetLevel(zap.DebugLevel)
+	default:
+		log.SetLevel(zap.InfoLevel)
+	}
+}
 
-		sourceIP := ip.SrcIP.String()
-		sourcePort := tcp.SrcPort.String()
+func (c *capture) handle(p gopacket.Packet) {
 
-		packet := c.packetPool.Get().(*packet)
+	if p == nil {
+		return
+	}
 
-		packet.seq = tcp.Seq
-		packet.from = net.JoinHostPort(sourceIP, sourcePort)
-		packet.payload = tcp.Payload
+	tcpLayer := p.Layer(layers.LayerTypeTCP)
+	if tcpLayer == nil {
+		return
+	}
+	tcp, _ := tcpLayer.(*layers.TCP)
+	if c.ports[int(tcp.DstPort)] == "" && c.ports[int(tcp.SrcPort)] == "" {
+		return
+	}
+
+	srcIP, dstIP, ok := networkAddresses(p)
+	if !ok {
+		return
+	}
 
-		c.connManager.push2conn(*packet)
+	// packets without payload still carry SYN, FIN and RST
+	ci := captureContext(p.Metadata().CaptureInfo)
+	c.assembler.AssembleWithContext(networkFlow(srcIP, dstIP), tcp, &ci)
+	c.resetFlows(&ci)
 
-		c.packetPool.Put(packet)
+	// timeouts follow the packet clock so pcap files replay the same way
+	// as live captures
+	if ci.Timestamp.Sub(c.lastFlush) >= flushInterval {
+		c.lastFlush = ci.Timestamp
+		c.assembler.FlushWithOptions(reassembly.FlushOptions{
+			T:  ci.Timestamp.Add(-gapTimeout),
+			TC: ci.Timestamp.Add(-c.idleTimeout),
+		})
 	}
-	return nil
 }
 
+// newPacketSource merges the packets of every device, or of the pcap file,
+// into a single channel.
 func (c *capture) newPacketSource() error {
-	handle, err := pcap.OpenLive(c.device, snaplen, promisc, pcap.BlockForever)
+	err := c.openHandles()
 	if err != nil {
-		return fmt.Errorf("opening device %s failed: %v\n", device, err)
+		return err
 	}
-	filter := fmt.Sprintf("tcp port %d and dst port %d", c.port, c.port)
-	err = handle.SetBPFFilter(filter)
-	if err != nil {
-		return fmt.Errorf("setting filter %s failed: %v\n", filter, err)
+	filter := c.filter()
+	c.packets = make(chan gopacket.Packet, packetQueueSize)
+	wg := sync.WaitGroup{}
+	for _, handle := range c.handles {
+		err = handle.SetBPFFilter(filter)
+		if err != nil {
+			return fmt.Errorf("setting filter %s failed: %v\n", filter, err)
+		}
+		source := gopacket.NewPacketSource(handle, handle.LinkType())
+		wg.Go(func() {
+			for p := range source.Packets() {
+				if !lossy {
+					c.packets <- p
+					continue
+				}
+				select {
+				case c.packets <- p:
+				default:
+					DroppedPacketCount.Add(1)
+				}
+			}
+		})
 	}
-	c.packetSource = gopacket.NewPacketSource(handle, handle.LinkType())
+	go func() {
+		wg.Wait()
+		close(c.packets)
+	}()
 	return nil
 }
 
-func createWriteBuffer() error {
-	fileName = fmt.Sprintf(fName, time.Now().Format("2006-01-02T15:04:05"))
-	f, err := os.Create(fileName)
-	if err != nil {
-		return err
+func (c *capture) openHandles() error {
+	if c.pcapFile != "" {
+		handle, err := pcap.OpenOffline(c.pcapFile)
+		if err != nil {
+			return fmt.Errorf("opening file %s failed: %v\n", c.pcapFile, err)
+		}
+		c.handles = append(c.handles, handle)
+		return nil
+	}
+	for _, device := range c.devices {
+		handle, err := pcap.OpenLive(device, snaplen, promisc, pcap.BlockForever)
+		if err != nil {
+			return fmt.Errorf("opening device %s failed: %v\n", device, err)
+		}
+		c.handles = append(c.handles, handle)
 	}
-	bufWriter = bufio.NewWriterSize(f, 256*1024)
 	return nil
 }
+
+// pcapDrops sums what pcap dropped on every device before it was read.
+func (c *capture) pcapDrops() pcapDrops {
+	var drops pcapDrops
+	for _, handle := range c.handles {
+		stats, err := handle.Stats()
+		if err != nil {
+			log.Debug("pcap stats failed", zap.Error(err))
+			continue
+		}
+		drops.Kernel += stats.PacketsDropped
+		drops.Interface += stats.PacketsIfDropped
+	}
+	return drops
+}
+
+func (c *capture) filter() string {
+	if c.bpf != "" {
+		return c.bpf
+	}
+	ports := make([]int, 0, len(c.ports))
+	for port := range c.ports {
+		ports = append(ports, port)
+	}
+	slices.Sort(ports)
+	primitives := make([]string, 0, len(ports))
+	for _, port := range ports {
+		primitives = append(primitives, fmt.Sprintf("port %d", port))
+	}
+	return fmt.Sprintf("tcp and (%s)", strings.Join(primitives, " or "))
+}
@@ -0,0 +1,335 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// replay feeds the packets of a pcap file through the assembler and the
+// conns the way a capture does, and returns the records and dead letters it
+// wrote. pcapgo reads the file so the test needs no libpcap.
+func replay(t *testing.T, file string) ([]QueryRecord, []deadLetter) {
+	t.Helper()
+	dir := t.TempDir()
+	c, err := newCapture(captureConfig{
+		ports:        []int{3306},
+		pgPorts:      []int{5432},
+		pcapFile:     file,
+		idleTimeout:  defaultIdleTimeout,
+		maxQuerySize: defaultMaxQuerySize,
+		sampleConn:   100,
+		tape:         TapeConfig{level: defaultLevel, outputDir: dir},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = openTape(c.tape)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	reader, err := pcapgo.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.assembler = newAssembler(c.connManager)
+	source := gopacket.NewPacketSource(reader, reader.LinkType())
+	for p := range source.Packets() {
+		c.handle(p)
+	}
+	c.assembler.FlushAll()
+	c.connManager.close()
+	err = finish(time.Now(), c.connManager.globalID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var records []QueryRecord
+	for _, line := range readLines(t, filepath.Join(dir, tape.name+".json")) {
+		var r QueryRecord
+		err = json.Unmarshal([]byte(line), &r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	// the dead-letter file is only created for the first letter
+	var letters []deadLetter
+	deadLetters := filepath.Join(dir, tape.name+deadLetterSuffix)
+	if _, err = os.Stat(deadLetters); os.IsNotExist(err) {
+		return records, nil
+	}
+	for _, line := range readLines(t, deadLetters) {
+		var d deadLetter
+		err = json.Unmarshal([]byte(line), &d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		letters = append(letters, d)
+	}
+	return records, letters
+}
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestCapturePcap(t *testing.T) {
+	records, letters := replay(t, "testdata/capture.pcap")
+
+	// record is what is checked of every record, digests and timings are
+	// left out
+	type record struct {
+		client       string
+		seq          int
+		batch        int
+		protocol     string
+		db           string
+		typ          string
+		text         string
+		params       []any
+		affectedRows uint64
+		returnedRows uint64
+		errorCode    uint16
+		sqlState     string
+	}
+	want := []record{
+		{client: "10.0.0.5:50000", seq: 1, protocol: mysqlProtocol, db: "shop", typ: "select", text: "select id from orders where id = 1;", returnedRows: 1},
+		{client: "10.0.0.5:50000", seq: 2, protocol: mysqlProtocol, db: "shop", typ: "insert", text: "insert into orders values (2);", affectedRows: 1},
+		{client: "10.0.0.5:50000", seq: 3, protocol: mysqlProtocol, db: "shop", typ: "select", text: "select id from orders where id = ?;", params: []any{"7"}, returnedRows: 1},
+		{client: "10.0.0.5:50000", seq: 4, protocol: mysqlProtocol, db: "shop", typ: "session", text: "use crm;"},
+		{client: "10.0.0.5:50000", seq: 5, batch: 5, protocol: mysqlProtocol, db: "crm", typ: "select", text: "select 1;", returnedRows: 1},
+		{client: "10.0.0.5:50000", seq: 6, batch: 5, protocol: mysqlProtocol, db: "crm", typ: "select", text: "select 2;", returnedRows: 1},
+		{client: "10.0.0.6:50001", seq: 1, protocol: postgresProtocol, db: "app", typ: "select", text: "select 1;", returnedRows: 1},
+		{client: "10.0.0.6:50001", seq: 2, protocol: postgresProtocol, db: "app", typ: "update", text: "update accounts set balance = ? where id = ?;", params: []any{"100", "7"}, affectedRows: 1},
+		{client: "10.0.0.6:50001", seq: 3, protocol: postgresProtocol, db: "app", typ: "select", text: "select * from missing;", errorCode: pgError, sqlState: "42P01"},
+	}
+	// conns flush their records independently of each other
+	slices.SortStableFunc(records, func(a, b QueryRecord) int {
+		return strings.Compare(a.Client, b.Client)
+	})
+	var got []record
+	for _, r := range records {
+		got = append(got, record{
+			client:       r.Client,
+			seq:          r.Seq,
+			batch:        r.Batch,
+			protocol:     r.Protocol,
+			db:           r.DB,
+			typ:          r.Type,
+			text:         r.Text,
+			params:       r.Params,
+			affectedRows: r.AffectedRows,
+			returnedRows: r.ReturnedRows,
+			errorCode:    r.ErrorCode,
+			sqlState:     r.SQLState,
+		})
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %d records, want %d", len(got), len(want))
+	}
+	for i := range min(len(got), len(want)) {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("record %d:\ngot  %+v\nwant %+v", i, got[i], want[i])
+		}
+	}
+	if len(records) > 0 {
+		r := records[0]
+		if r.User != "app" || r.Server != "10.0.0.1:3306" || r.Charset != "utf8mb4" {
+			t.Errorf("got session %s of %s to %s, want app of utf8mb4 to 10.0.0.1:3306", r.User, r.Charset, r.Server)
+		}
+		// the packets of the fixture are 1ms apart
+		if r.ResponseTime != 1000 {
+			t.Errorf("got response time %dµs, want 1000µs", r.ResponseTime)
+		}
+	}
+
+	if len(letters) != 1 || letters[0].Seq != 7 || letters[0].Command != "0x03" || string(letters[0].Raw) != "\x03selec broken" {
+		t.Errorf("got dead letters %+v, want the query that failed to parse", letters)
+	}
+}
+
+// tcpSession writes the segments of TCP connections between 10.0.0.7:50002
+// and 10.0.0.1:3306 to a pcap file, 1ms apart.
+type tcpSession struct {
+	t         *testing.T
+	f         *os.File
+	w         *pcapgo.Writer
+	ts        time.Time
+	clientSeq uint32
+	serverSeq uint32
+}
+
+func newTCPSession(t *testing.T) *tcpSession {
+	t.Helper()
+	f, err := os.Create(filepath.Join(t.TempDir(), "session.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := pcapgo.NewWriter(f)
+	err = w.WriteFileHeader(65536, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tcpSession{t: t, f: f, w: w, ts: time.Date(2026, 10, 17, 8, 0, 0, 0, time.UTC), clientSeq: 1000, serverSeq: 5000}
+}
+
+// send writes a segment of the client, or of the server when fromServer is
+// set. Every segment but the opening SYN acknowledges the other side.
+func (s *tcpSession) send(fromServer bool, tcp layers.TCP, payload []byte) {
+	s.t.Helper()
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IPv4(10, 0, 0, 7), DstIP: net.IPv4(10, 0, 0, 1)}
+	tcp.SrcPort, tcp.DstPort = 50002, 3306
+	seq, ack := &s.clientSeq, &s.serverSeq
+	if fromServer {
+		ip.SrcIP, ip.DstIP = ip.DstIP, ip.SrcIP
+		tcp.SrcPort, tcp.DstPort = tcp.DstPort, tcp.SrcPort
+		seq, ack = ack, seq
+	}
+	tcp.Seq, tcp.Ack, tcp.ACK, tcp.Window = *seq, *ack, !tcp.SYN || fromServer, 65535
+	*seq += uint32(len(payload))
+	if tcp.SYN || tcp.FIN {
+		*seq++
+	}
+	err := tcp.SetNetworkLayerForChecksum(ip)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	err = gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{SrcMAC: net.HardwareAddr{2, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{2, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4},
+		ip, &tcp, gopacket.Payload(payload))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	s.ts = s.ts.Add(time.Millisecond)
+	err = s.w.WritePacket(gopacket.CaptureInfo{Timestamp: s.ts, CaptureLength: len(buf.Bytes()), Length: len(buf.Bytes())}, buf.Bytes())
+	if err != nil {
+		s.t.Fatal(err)
+	}
+}
+
+// open writes the three-way handshake of a connection.
+func (s *tcpSession) open() {
+	s.t.Helper()
+	s.send(false, layers.TCP{SYN: true}, nil)
+	s.send(true, layers.TCP{SYN: true}, nil)
+	s.send(false, layers.TCP{}, nil)
+}
+
+// request writes MySQL packets of the client in one segment, reply those
+// of the server.
+func (s *tcpSession) request(packets ...[]byte) {
+	s.t.Helper()
+	s.send(false, layers.TCP{PSH: true}, bytes.Join(packets, nil))
+}
+
+func (s *tcpSession) reply(packets ...[]byte) {
+	s.t.Helper()
+	s.send(true, layers.TCP{PSH: true}, bytes.Join(packets, nil))
+}
+
+// query opens a connection, sends query and the OK of the server.
+func (s *tcpSession) query(query string) {
+	s.t.Helper()
+	s.open()
+	s.request(mysqlPacket(0, append([]byte{0x03}, query...)))
+	s.reply(mysqlPacket(1, []byte{okPacket, 0x01, 0x00, 0x02, 0x00, 0x00, 0x00}))
+}
+
+// replay closes both halves of the connection and replays the file.
+func (s *tcpSession) replay() ([]QueryRecord, []deadLetter) {
+	s.t.Helper()
+	s.send(false, layers.TCP{FIN: true}, nil)
+	s.send(true, layers.TCP{FIN: true}, nil)
+	err := s.f.Close()
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	records, letters := replay(s.t, s.f.Name())
+	// conns flush their records independently of each other
+	slices.SortStableFunc(records, func(a, b QueryRecord) int {
+		return a.Conn - b.Conn
+	})
+	return records, letters
+}
+
+func TestCaptureResetPortReuse(t *testing.T) {
+	s := newTCPSession(t)
+	s.query("delete from a;")
+	s.send(false, layers.TCP{RST: true}, nil)
+	// the client opens a new connection from the same port
+	s.clientSeq, s.serverSeq = 90000, 70000
+	s.query("delete from b;")
+	records, _ := s.replay()
+
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	for i, text := range []string{"delete from a;", "delete from b;"} {
+		if records[i].Text != text || records[i].AffectedRows != 1 {
+			t.Errorf("record %d: got %q with %d rows, want %q with 1", i, records[i].Text, records[i].AffectedRows, text)
+		}
+	}
+	if records[0].Conn == records[1].Conn {
+		t.Errorf("got both queries on conn %d, want a conn each", records[0].Conn)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		cfg  captureConfig
+		want string
+	}{
+		{cfg: captureConfig{duration: -time.Second}, want: "--duration can't be negative"},
+		{cfg: captureConfig{maxQueries: -1}, want: "--max-queries can't be negative"},
+		{cfg: captureConfig{maxSize: -1}, want: "--max-size can't be negative"},
+		{cfg: captureConfig{maxQuerySize: -1}, want: "--max-query-size can't be negative"},
+	}
+	for _, tt := range tests {
+		tt.cfg.ports = []int{3306}
+		_, err := newCapture(tt.cfg)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("got %v, want %s", err, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		cfg  TapeConfig
+		want string
+	}{
+		{cfg: TapeConfig{rotateSize: -1}, want: "--rotate-size can't be negative"},
+		{cfg: TapeConfig{rotateInterval: -time.Minute}, want: "--rotate-interval can't be negative"},
+	} {
+		tt.cfg.level = defaultLevel
+		err := openTape(tt.cfg)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("got %v, want %s", err, tt.want)
+		}
+	}
+	_, err := NewRecorder(TapeConfig{level: defaultLevel}, -1)
+	if err == nil || err.Error() != "--max-query-size can't be negative" {
+		t.Errorf("got %v, want --max-query-size can't be negative", err)
+	}
+}
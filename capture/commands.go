@@ -2,6 +2,8 @@ package capture
 
 import (
 	"fmt"
+	"slices"
+	"time"
 
 	"github.com/urfave/cli/v2"
 )
@@ -9,32 +11,184 @@ import (
 const (
 	device        = "device"
 	port          = "port"
+	pgPort        = "pg-port"
 	defaultDevice = "lo0"
 	defaultPort   = 3306
 	level         = "level"
 	defaultLevel  = "info"
+	pcapFile      = "pcap-file"
+	bpf           = "bpf"
+	idleTimeout   = "idle-timeout"
+	duration      = "duration"
+	maxQueries    = "max-queries"
+	maxSize       = "max-size"
+	outputDir     = "output-dir"
+	rotateSize    = "rotate-size"
+	rotate        = "rotate-interval"
+	compression   = "compress"
+	maxQuerySize  = "max-query-size"
+	redact        = "redact"
+	redactSalt    = "redact-salt"
+	redactColumn  = "redact-column"
+	sampleConn    = "sample-conn"
+	sampleType    = "sample-type"
+	sampleDigest  = "sample-digest"
+
+	defaultMaxQuerySize = 64
+
+	defaultIdleTimeout = 10 * time.Minute
 )
 
+// TapeFlags are the flags of every command writing a tape, read them back
+// with NewTapeConfig.
+var TapeFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name: level, Usage: "info and debug",
+		Value: defaultLevel,
+	},
+	&cli.StringFlag{
+		Name: outputDir, Usage: "directory the tape is written to",
+		Value: ".",
+	},
+	&cli.IntFlag{
+		Name: rotateSize, Usage: "start a new tape segment once the current one reaches this many MB",
+	},
+	&cli.DurationFlag{
+		Name: rotate, Usage: "start a new tape segment once the current one is this old",
+	},
+	&cli.StringFlag{
+		Name: compression, Usage: "compress closed tape segments with gzip or zstd",
+	},
+	&cli.StringFlag{
+		Name: redact, Usage: "rewrite literals before they are written, mask replaces them with ? and hash with a salted hash",
+	},
+	&cli.StringFlag{
+		Name: redactSalt, Usage: "secret salt of hash redaction",
+		EnvVars: []string{"CASSETTE_REDACT_SALT"},
+	},
+	&cli.StringSliceFlag{
+		Name: redactColumn, Usage: "only redact values compared with or assigned to columns whose name contains this, repeat for several",
+	},
+}
+
+// MaxQuerySizeFlag is the flag of the commands decoding the wire protocol.
+var MaxQuerySizeFlag = &cli.IntFlag{
+	Name: maxQuerySize, Usage: "skip commands larger than this many MB, 0 means no limit",
+	Value: defaultMaxQuerySize,
+}
+
+// TapeConfig holds the values of TapeFlags, sizes are in MB.
+type TapeConfig struct {
+	level          string
+	outputDir      string
+	rotateSize     int
+	rotateInterval time.Duration
+	compression    string
+	redact         string
+	redactSalt     string
+	redactColumns  []string
+}
+
+func NewTapeConfig(context *cli.Context) TapeConfig {
+	return TapeConfig{
+		level:          context.String(level),
+		outputDir:      context.String(outputDir),
+		rotateSize:     context.Int(rotateSize),
+		rotateInterval: context.Duration(rotate),
+		compression:    context.String(compression),
+		redact:         context.String(redact),
+		redactSalt:     context.String(redactSalt),
+		redactColumns:  context.StringSlice(redactColumn),
+	}
+}
+
+// limit is the value of a flag that can't be negative.
+type limit struct {
+	flag  string
+	value int64
+}
+
+// checkLimits returns an error naming the first flag whose value is
+// negative.
+func checkLimits(limits ...limit) error {
+	for _, l := range limits {
+		if l.value < 0 {
+			return fmt.Errorf("--%s can't be negative", l.flag)
+		}
+	}
+	return nil
+}
+
 var Commands = &cli.Command{
 	Name: "capture",
-	Flags: []cli.Flag{
+	Flags: slices.Concat([]cli.Flag{
+		&cli.StringSliceFlag{
+			Name: device, Value: cli.NewStringSlice(defaultDevice),
+			Usage: "repeat to capture from several interfaces",
+		},
+		&cli.IntSliceFlag{
+			Name: port, Value: cli.NewIntSlice(defaultPort),
+			Usage: "repeat to capture several mysqld instances, traffic to these ports is treated as queries",
+		},
+		&cli.IntSliceFlag{
+			Name: pgPort, Usage: "repeat to capture several PostgreSQL servers, --port is then only used when given",
+		},
+		&cli.StringFlag{
+			Name: bpf, Usage: "raw BPF expression replacing the filter built from --port and --pg-port, which must still name the server ports",
+		},
 		&cli.StringFlag{
-			Name: device, Value: defaultDevice,
+			Name: pcapFile, Usage: "read packets from a pcap/pcapng file instead of a live device",
+		},
+		&cli.DurationFlag{
+			Name: idleTimeout, Usage: "close connections without any traffic for this long",
+			Value: defaultIdleTimeout,
+		},
+		&cli.DurationFlag{
+			Name: duration, Usage: "stop capturing after this long, 0 means no limit",
 		},
 		&cli.IntFlag{
-			Name: port, Value: defaultPort,
+			Name: maxQueries, Usage: "stop capturing once this many queries are written, 0 means no limit",
 		},
-		&cli.StringFlag{
-			Name: level, Usage: "info and debug",
-			Value: defaultLevel,
+		&cli.IntFlag{
+			Name: maxSize, Usage: "stop capturing once the tape reaches this many MB, 0 means no limit",
 		},
-	},
+		MaxQuerySizeFlag,
+		&cli.Float64Flag{
+			Name: sampleConn, Usage: "keep this percentage of connections, picked by client address",
+			Value: 100,
+		},
+		&cli.StringSliceFlag{
+			Name: sampleType, Usage: "keep this percentage of the statements of a type, e.g. select=10, repeat for several types",
+		},
+		&cli.IntFlag{
+			Name: sampleDigest, Usage: "keep at most this many queries per digest per second, 0 means no limit",
+		},
+	}, TapeFlags),
 	Action: func(context *cli.Context) error {
-		c, err := newCapture(
-			context.String(device),
-			context.Int(port),
-			context.String(level),
-		)
+		// the ports tell the server side of the traffic the filter lets in
+		if context.IsSet(bpf) && !context.IsSet(port) && !context.IsSet(pgPort) {
+			return fmt.Errorf("--%s needs the server ports given with --%s or --%s", bpf, port, pgPort)
+		}
+		ports := context.IntSlice(port)
+		if context.IsSet(pgPort) && !context.IsSet(port) {
+			ports = nil
+		}
+		c, err := newCapture(captureConfig{
+			devices:      context.StringSlice(device),
+			ports:        ports,
+			pgPorts:      context.IntSlice(pgPort),
+			pcapFile:     context.String(pcapFile),
+			bpf:          context.String(bpf),
+			idleTimeout:  context.Duration(idleTimeout),
+			duration:     context.Duration(duration),
+			maxQueries:   context.Int(maxQueries),
+			maxSize:      context.Int(maxSize),
+			maxQuerySize: context.Int(maxQuerySize),
+			tape:         NewTapeConfig(context),
+			sampleConn:   context.Float64(sampleConn),
+			sampleTypes:  context.StringSlice(sampleType),
+			sampleDigest: context.Int(sampleDigest),
+		})
 		if err != nil {
 			return fmt.Errorf("create capture failed: %w", err)
 		}
@@ -0,0 +1,109 @@
+package capture
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	clientCompress                 = 0x00000020
+	clientZstdCompressionAlgorithm = 0x04000000
+
+	compressedHeaderSize = 7
+)
+
+var (
+	zstdMagic      = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// compress switches both directions of the conn to the compressed protocol.
+func (w *mysqlWire) compress(c *conn) {
+	w.client.compress()
+	w.server.compress()
+	CompressedConnCount.Add(1)
+	log.Debug("conn switched to compression",
+		zap.Int("conn", c.id),
+		zap.Int("router", c.router),
+		zap.String("from", c.from))
+}
+
+// compress makes the stream unwrap compressed packets before splitting MySQL
+// packets. Whatever is left in the buffer arrived after the switch and is
+// compressed as well.
+func (s *stream) compress() {
+	if s.compressed != nil {
+		return
+	}
+	s.compressed = &bytes.Buffer{}
+	s.compressed.Write(s.buffer.Bytes())
+	s.buffer.Reset()
+}
+
+// inflate moves every complete compressed packet to the buffer. zlib and
+// zstd payloads are told apart by their magic bytes.
+func (s *stream) inflate() error {
+	for {
+		data := s.compressed.Bytes()
+		if len(data) < compressedHeaderSize {
+			return nil
+		}
+		length := int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+		if len(data) < compressedHeaderSize+length {
+			return nil
+		}
+		uncompressed := int(data[4]) | int(data[5])<<8 | int(data[6])<<16
+		frame := s.compressed.Next(compressedHeaderSize + length)[compressedHeaderSize:]
+		if uncompressed == 0 {
+			s.buffer.Write(frame)
+			continue
+		}
+		payload, err := decompress(frame, uncompressed)
+		if err != nil {
+			return err
+		}
+		s.buffer.Write(payload)
+	}
+}
+
+func decompress(frame []byte, size int) ([]byte, error) {
+	if bytes.HasPrefix(frame, zstdMagic) {
+		return zstdDecoder.DecodeAll(frame, make([]byte, 0, size))
+	}
+	r, err := zlib.NewReader(bytes.NewReader(frame))
+	if err != nil {
+		return nil, fmt.Errorf("open zlib payload failed: %w", err)
+	}
+	defer r.Close()
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("inflate zlib payload failed: %w", err)
+	}
+	return payload, nil
+}
+
+// looksCompressed guesses whether the first client payload of a connection
+// seen mid-stream is a compressed packet. A plain packet spans 4 bytes more
+// than its length header, a compressed one 7.
+func looksCompressed(payload []byte) bool {
+	if len(payload) < compressedHeaderSize+4 {
+		return false
+	}
+	length := int(payload[0]) | int(payload[1])<<8 | int(payload[2])<<16
+	if len(payload) != compressedHeaderSize+length {
+		return false
+	}
+	uncompressed := int(payload[4]) | int(payload[5])<<8 | int(payload[6])<<16
+	frame := payload[compressedHeaderSize:]
+	if uncompressed == 0 {
+		inner := int(frame[0]) | int(frame[1])<<8 | int(frame[2])<<16
+		return len(frame) == inner+4 && frame[3] == 0
+	}
+	return frame[0] == 0x78 || bytes.HasPrefix(frame, zstdMagic)
+}
@@ -1,9 +1,8 @@
 package capture
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
-	"os"
 	"sync"
 	"time"
 
@@ -14,140 +13,370 @@ import (
 )
 
 type conn struct {
-	id                  int
-	router              int
-	from                string
-	packetChan          chan *packet
-	connChan            chan *conn
-	queryRecordChan     chan *QueryRecord
-	nextSeq             uint32
+	id         int
+	router     int
+	from       string
+	server     string
+	protocol   protocol
+	packetChan chan *packet
+	connChan   chan *conn
+	done       chan struct{}
+	pending    *QueryRecord
+	queued     []*QueryRecord
+	result     result
+	session    session
+	encrypted  bool
+	// proxied conns see the traffic after TLS is terminated, so an SSLRequest
+	// is followed by the real handshake response
+	proxied             bool
 	lastPacketTimestamp string
-	buffer              *bytes.Buffer
-	parser              *parser.Parser
-	file                *os.File
-	mutex               sync.Mutex
+	// seq numbers the query records of the conn in the order they were sent
+	seq    int
+	parser *parser.Parser
+	mutex  sync.Mutex
 }
 
-func newConn(id int, router int, from string, connChan chan *conn) (*conn, error) {
+func newConn(id int, router int, from string, server string, protocol string, connChan chan *conn, done chan struct{}, maxQuerySize int) *conn {
 	c := &conn{
-		id:              id,
-		router:          router,
-		from:            from,
-		packetChan:      make(chan *packet, 1024),
-		connChan:        connChan,
-		queryRecordChan: make(chan *QueryRecord, 1024),
-		parser:          parser.New(),
-		mutex:           sync.Mutex{},
-	}
-	f, err := os.Open(fileName)
-	if err != nil {
-		return nil, err
+		id:         id,
+		router:     router,
+		from:       from,
+		server:     server,
+		protocol:   newProtocol(protocol, maxQuerySize),
+		packetChan: make(chan *packet, 1024),
+		connChan:   connChan,
+		done:       done,
+		parser:     parser.New(),
+		mutex:      sync.Mutex{},
 	}
-	c.file = f
-	return c, nil
+	return c
+}
+
+func (c *conn) key() string {
+	return c.from + "-" + c.server
 }
 
+// run parses the packets of the conn until the connection is closed, which
+// the assembler signals by closing packetChan, or until the capture stops.
 func (c *conn) run() {
+	defer c.close()
 	for {
 		select {
-		case packet := <-c.packetChan:
+		case packet, ok := <-c.packetChan:
+			if !ok {
+				return
+			}
 			c.analyze(*packet)
-		case queryRecord := <-c.queryRecordChan:
-			queryRecord.flush()
+		case <-c.done:
+			c.drain()
+			return
 		}
 	}
 }
 
+func (c *conn) drain() {
+	for {
+		select {
+		case packet, ok := <-c.packetChan:
+			if !ok {
+				return
+			}
+			c.analyze(*packet)
+		default:
+			return
+		}
+	}
+}
+
+// close flushes whatever the conn still holds and hands it to the manager to
+// be forgotten.
+func (c *conn) close() {
+	c.flushPending()
+	c.connChan <- c
+}
+
 func (c *conn) analyze(p packet) {
 
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	if c.nextSeq == 0 {
-		c.nextSeq = p.seq + uint32(len(p.payload))
-		c.buffer = bytes.NewBuffer(p.payload)
-	} else {
-		if p.seq == c.nextSeq {
-			c.nextSeq = p.seq + uint32(len(p.payload))
-			c.buffer.Write(p.payload)
-		} else if p.seq > c.nextSeq {
-			log.Debug(
-				"sequence number discontinuity detected",
-				zap.Int("conn", c.id),
-				zap.Int("router", c.router),
-				zap.Uint32("seq", p.seq),
-				zap.Uint32("next", c.nextSeq),
-			)
-			TotalLostPacketCount.Add(1)
-			c.buffer.Reset()
-			c.buffer.Write(p.payload)
-			c.nextSeq = p.seq + uint32(len(p.payload))
-		} else {
-			TotalOutOrderCount.Add(1)
-			log.Debug(
-				"out-of-order packet skipped",
-				zap.Int("conn", c.id),
-				zap.Int("router", c.router),
-				zap.Uint32("seq", p.seq),
-				zap.Uint32("next", c.nextSeq),
-			)
-		}
+	if c.encrypted {
+		return
 	}
-	c.filterMySQLPacket()
+	if p.response {
+		c.protocol.response(c, p)
+		return
+	}
+	c.protocol.request(c, p)
+}
+
+// mysqlWire is the MySQL client/server protocol. COM_QUERY and executions of
+// prepared statements become records, the handshake gives the session.
+type mysqlWire struct {
+	client    *stream
+	server    *stream
+	stmts     map[uint32]*statement
+	preparing *statement
+	useDB     string
+	// changeUser is the session asked for by COM_CHANGE_USER until the
+	// server accepts it
+	changeUser *session
+	handshake  bool
+	probed     bool
+	// sslRequest is set once a proxied client asked for TLS, its handshake
+	// response then comes with seq 2
+	sslRequest bool
+}
+
+func newMySQLWire(maxQuerySize int) *mysqlWire {
+	return &mysqlWire{
+		client: newStream(maxQuerySize),
+		server: newStream(0),
+		stmts:  make(map[uint32]*statement),
+	}
+}
+
+func (w *mysqlWire) name() string {
+	return mysqlProtocol
 }
 
-func (c *conn) filterMySQLPacket() {
-	data := c.buffer.Bytes()
+func (w *mysqlWire) request(c *conn, p packet) {
+	if !w.probed && len(p.payload) > 0 {
+		// connections seen from the start learn about compression from
+		// the handshake instead
+		w.probed = true
+		if !w.handshake && looksCompressed(p.payload) {
+			w.server.reset()
+			w.compress(c)
+		}
+	}
+	w.client.push(c, p)
+	w.filterMySQLPacket(c, p)
+}
 
-	for len(data) >= 4 {
-		length := uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16
+func (w *mysqlWire) response(c *conn, p packet) {
+	w.server.push(c, p)
+	w.filterResponse(c, p)
+}
 
-		if len(data) < int(length)+4 {
+func (w *mysqlWire) filterMySQLPacket(c *conn, p packet) {
+	for {
+		seq, mysqlPacket, ok := w.client.next()
+		if !ok {
 			return
 		}
+		if mysqlPacket == nil {
+			w.skip(c, seq)
+			continue
+		}
 
-		mysqlPacket := data[4 : 4+length]
+		// commands always start a new sequence, anything else belongs to
+		// the handshake or to the command in flight
+		if seq != 0 {
+			if w.handshake && (seq == 1 || (seq == 2 && w.sslRequest)) {
+				w.onHandshakeResponse(c, mysqlPacket)
+			}
+			continue
+		}
+		w.handshake = false
+		w.switchDB(c, true)
+		w.switchUser(c, true)
 
+		// COM_STMT_FETCH reads rows of the cursor opened by the execution
+		// in flight, they are its result
+		if len(mysqlPacket) > 0 && mysqlPacket[0] == 0x1c {
+			continue
+		}
 		if len(mysqlPacket) > 0 {
-			c.setTimestamp()
+			c.setTimestamp(p.timestamp)
+			c.result = result{}
+			w.preparing = nil
 			command := mysqlPacket[0]
 			switch command {
 			case 0x01:
-				c.connChan <- c
-			case 0x02, 0x04, 0x16, 0x17, 0x19, 0x8f:
+				// the conn is closed once the server drops the connection
+				c.flushPending()
+			case 0x02:
+				w.useDB = string(mysqlPacket[1:])
+			case 0x04, 0x8f:
+			case 0x09, 0x0e, 0x1b:
+				// statistics, ping and set option carry no query, their
+				// reply must not go to the one before
+				c.flushPending()
+			case 0x11:
+				c.flushPending()
+				w.onChangeUser(c, mysqlPacket)
+			case 0x1f:
+				// a reset connection forgets its prepared statements
+				c.flushPending()
+				clear(w.stmts)
+			case 0x16:
+				c.flushPending()
+				w.preparing = &statement{
+					query: string(mysqlPacket[1:]),
+				}
+			case 0x17:
+				c.flushPending()
+				w.execute(c, mysqlPacket, p)
+			case 0x18:
+				w.onSendLongData(c, mysqlPacket)
+			case 0x19:
+				w.onStmtClose(c, mysqlPacket)
+			case 0x1a:
+				w.onStmtReset(c, mysqlPacket)
 			case 0x03:
+				c.flushPending()
+				text, err := c.queryText(mysqlPacket)
+				if err != nil {
+					c.deadLetter(0, mysqlPacket, err)
+					break
+				}
 				queries := []string{
-					string(mysqlPacket[1:]),
+					string(text),
 				}
 				qr := newQueryRecord(
-					c.lastPacketTimestamp, c.id, c.router,
-					c.from, queries, c.parser)
+					c.lastPacketTimestamp, p.timestamp, c.id, c.router,
+					c.from, c.server, mysqlProtocol, c.session, queries, c.parser)
 				qr.clean()
-				err := qr.check()
+				// an empty query only earns an error from the server
+				if len(qr.queries) == 0 {
+					break
+				}
+				records, err := qr.check()
 				if err != nil {
 					log.Warn("parse error",
-						zap.String("sql", qr.queries[0]),
-						zap.String("err", err.Error()))
+						parseErrorFields(qr.queries[0], err)...)
+					c.seq++
+					// keep the bare query, replay may send it verbatim
+					c.deadLetter(c.seq, append([]byte{0x03}, text...), err)
+					break
+				}
+				if len(records) == 0 {
 					break
 				}
-				c.queryRecordChan <- qr
+				w.batch(c, records)
 			default:
 				log.Debug("unknown command",
 					zap.Int("conn", c.id),
 					zap.Int("router", c.router),
 					zap.String("type", fmt.Sprintf("0x%02x", command)))
 				UnknownCommandCount.Add(1)
+				c.flushPending()
+				c.deadLetter(0, mysqlPacket, errors.New("unknown command"))
 			}
 		}
-		data = data[4+length:]
 	}
+}
+
+func (w *mysqlWire) execute(c *conn, mysqlPacket []byte, p packet) {
+	stmt, params, err := w.decodeExecute(c, mysqlPacket)
+	if err != nil {
+		log.Debug("decode execute failed",
+			zap.Int("conn", c.id),
+			zap.Int("router", c.router),
+			zap.Error(err))
+		UnknownStatementCount.Add(1)
+		c.deadLetter(0, mysqlPacket, err)
+		return
+	}
+	qr := newQueryRecord(
+		c.lastPacketTimestamp, p.timestamp, c.id, c.router,
+		c.from, c.server, mysqlProtocol, c.session, []string{stmt.query}, c.parser)
+	qr.clean()
+	if len(qr.queries) == 0 {
+		return
+	}
+	records, err := qr.check()
+	if err != nil {
+		log.Warn("parse error",
+			parseErrorFields(qr.queries[0], err)...)
+		c.deadLetter(0, mysqlPacket, err)
+		return
+	}
+	if len(records) == 0 {
+		return
+	}
+	qr.Params = params
+	qr.redactParams()
+	c.seq++
+	qr.Seq = c.seq
+	c.pending = qr
+}
+
+// batch numbers the statements of a COM_QUERY and makes the first one wait
+// for its reply. With CLIENT_MULTI_STATEMENTS the others are queued, each
+// result set of the reply goes to the next statement.
+func (w *mysqlWire) batch(c *conn, records []*QueryRecord) {
+	db := c.session.DB
+	for _, qr := range records {
+		c.seq++
+		qr.Seq = c.seq
+		if len(records) > 1 {
+			qr.Batch = records[0].Seq
+		}
+		// a USE inside the batch applies to the statements after it
+		qr.DB = db
+		if qr.use != "" {
+			db = qr.use
+			w.useDB = qr.use
+		}
+	}
+	c.pending = records[0]
+	c.queued = records[1:]
+}
+
+// skip drops a packet that went over --max-query-size. A skipped command
+// still ends the one in flight, and its reply is left unpaired.
+func (w *mysqlWire) skip(c *conn, seq byte) {
+	if seq != 0 {
+		return
+	}
+	log.Warn("query over max query size skipped",
+		zap.Int("conn", c.id),
+		zap.Int("router", c.router),
+		zap.String("from", c.from))
+	OversizedQueryCount.Add(1)
+	w.handshake = false
+	w.switchDB(c, true)
+	w.switchUser(c, true)
+	c.flushPending()
+	c.result = result{}
+	w.preparing = nil
+}
+
+// switchDB applies the schema change requested by COM_INIT_DB or USE once
+// the server has accepted it. A change whose reply was never seen is assumed
+// to have succeeded when the next command arrives.
+func (w *mysqlWire) switchDB(c *conn, ok bool) {
+	if w.useDB == "" {
+		return
+	}
+	if ok {
+		c.session.DB = w.useDB
+	}
+	w.useDB = ""
+}
+
+// flushPending flushes a query whose response was never seen, e.g. when
+// the capture started in the middle of it or the reply was lost.
+func (c *conn) flushPending() {
+	if c.pending == nil {
+		return
+	}
+	c.pending.flush()
+	c.pending = nil
+	c.flushQueued()
+}
 
-	c.buffer.Reset()
-	if len(data) > 0 {
-		c.buffer.Write(data)
+// flushQueued flushes the statements of a batch that got no result, the
+// server stops running a batch at the first error.
+func (c *conn) flushQueued() {
+	for _, qr := range c.queued {
+		qr.flush()
 	}
+	c.queued = nil
 }
 
-func (c *conn) setTimestamp() {
-	c.lastPacketTimestamp = time.Now().Format("2006-01-02 15:04:05")
+func (c *conn) setTimestamp(t time.Time) {
+	c.lastPacketTimestamp = t.Format(timestampLayout)
 }
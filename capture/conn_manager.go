@@ -10,14 +10,25 @@ import (
 )
 
 type connManager struct {
-	routers    []*router
+	// ports maps the server ports to the protocol they speak
+	ports map[int]string
+	// maxQuerySize caps the bytes buffered for a single command
+	maxQuerySize int
+	// proxied is set when the conns are fed by the proxy, which terminates
+	// TLS itself
+	proxied bool
+	routers []*router
+	// resets are the streams reset by the packet being assembled
+	resets     []*tcpStream
 	connChan   chan *conn
+	done       chan struct{}
+	wg         sync.WaitGroup
 	globalID   int
 	cmMutex    sync.Mutex
 	closeMutex sync.Mutex
 }
 
-func newConnManager() *connManager {
+func newConnManager(ports map[int]string, maxQuerySize int) *connManager {
 
 	size := routerSize()
 	routers := make([]*router, size)
@@ -25,64 +36,78 @@ func newConnManager() *connManager {
 		routers[i] = newRouter(i)
 	}
 	cm := &connManager{
-		connChan: make(chan *conn),
-		routers:  routers,
+		ports:        ports,
+		maxQuerySize: maxQuerySize,
+		connChan:     make(chan *conn),
+		done:         make(chan struct{}),
+		routers:      routers,
 	}
 	go cm.closeWorker()
 	return cm
 }
 
-var startStatisticsTimer = false
+// startStatisticsTimer starts the statistics log with the first conn, which
+// the proxy may open from several goroutines at once
+var startStatisticsTimer sync.Once
 
-func (cm *connManager) push2conn(packet packet) {
+// newConn registers a conn for a connection the assembler just picked up. A
+// conn left over from an earlier connection on the same addresses is
+// replaced.
+func (cm *connManager) newConn(from string, server string, protocol string) *conn {
 
-	if !startStatisticsTimer {
-		startStatisticsTimer = true
+	startStatisticsTimer.Do(func() {
 		go statisticsTimer()
-	}
+	})
 
-	from := packet.from
-	index := hash(from, len(cm.routers))
+	key := from + "-" + server
+	index := hash(key, len(cm.routers))
 	router := cm.routers[index]
-	conns := router.conns
-
-	var c *conn
-	var exists bool
-	if c, exists = conns[from]; !exists {
-		cm.cmMutex.Lock()
-		cm.globalID++
-		cm.cmMutex.Unlock()
-
-		var err error
-		c, err = newConn(
-			cm.globalID,
-			router.index,
-			from,
-			cm.connChan,
-		)
-		if err != nil {
-			log.Fatal("open file failed",
-				zap.String("file", fileName),
-				zap.Error(err),
-			)
-		}
-		log.Debug("conn established",
-			zap.Int("conn", c.id),
-			zap.Int("router", router.index),
-			zap.String("from", from),
-		)
-		CurrentConnCount.Add(1)
-		router.conns[from] = c
-		go c.run()
-	}
-	c.packetChan <- &packet
+
+	cm.cmMutex.Lock()
+	cm.globalID++
+	id := cm.globalID
+	cm.cmMutex.Unlock()
+
+	c := newConn(
+		id,
+		router.index,
+		from,
+		server,
+		protocol,
+		cm.connChan,
+		cm.done,
+		cm.maxQuerySize,
+	)
+	c.proxied = cm.proxied
+	log.Debug("conn established",
+		zap.Int("conn", c.id),
+		zap.Int("router", router.index),
+		zap.String("from", from),
+		zap.String("server", server),
+		zap.String("protocol", protocol),
+	)
+	CurrentConnCount.Add(1)
+	cm.closeMutex.Lock()
+	router.conns[key] = c
+	cm.closeMutex.Unlock()
+	cm.wg.Go(c.run)
+	return c
+}
+
+// close stops the conns still open once the packets already pushed to them
+// have been parsed and their query records flushed.
+func (cm *connManager) close() {
+	close(cm.done)
+	cm.wg.Wait()
 }
 
 func (cm *connManager) closeWorker() {
 	for conn := range cm.connChan {
 		cm.closeMutex.Lock()
 		conns := cm.routers[conn.router].conns
-		delete(conns, conn.from)
+		if conns[conn.key()] == conn {
+			delete(conns, conn.key())
+		}
 		cm.closeMutex.Unlock()
 
 		TotalCloseConnCount.Add(1)
@@ -0,0 +1,97 @@
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const deadLetterSuffix = ".dead"
+
+// deadLetter is a command that could not be turned into a query record. It is
+// written to Queries_<time>.dead next to the tape with the raw bytes of the
+// MySQL packet, base64 encoded, so nothing is lost silently.
+type deadLetter struct {
+	Timestamp string `json:"timestamp"`
+	Conn      int    `json:"conn"`
+	// Seq is only set for queries the parser rejected, it places them among
+	// the records of the conn
+	Seq     int    `json:"seq"`
+	Client  string `json:"client"`
+	Server  string `json:"server"`
+	DB      string `json:"db"`
+	Command string `json:"command"`
+	Error   string `json:"error"`
+	Raw     []byte `json:"raw"`
+}
+
+var (
+	deadLetterMutex sync.Mutex
+	deadLetterFile  *os.File
+)
+
+// deadLetter records payload as lost, seq is 0 unless the payload is a query
+// that replay may send verbatim.
+func (c *conn) deadLetter(seq int, payload []byte, err error) {
+	d := &deadLetter{
+		Timestamp: c.lastPacketTimestamp,
+		Conn:      c.id,
+		Seq:       seq,
+		Client:    c.from,
+		Server:    c.server,
+		DB:        c.session.DB,
+		Command:   fmt.Sprintf("0x%02x", payload[0]),
+		Error:     err.Error(),
+		Raw:       payload,
+	}
+	writeDeadLetter(d)
+}
+
+// writeDeadLetter appends d to the dead-letter file of the tape.
+func writeDeadLetter(d *deadLetter) {
+	// the raw bytes and the parser error quote the query, keep neither when
+	// queries are redacted
+	if redaction != nil {
+		d.Raw = nil
+		d.Error = "redacted"
+	}
+	jsonData, err := json.Marshal(d)
+	if err != nil {
+		log.Warn("marshal dead letter failed", zap.Error(err))
+		return
+	}
+
+	deadLetterMutex.Lock()
+	defer deadLetterMutex.Unlock()
+
+	// the file is only created once there is something to put in it
+	if deadLetterFile == nil {
+		deadLetterFile, err = os.Create(filepath.Join(tape.dir, tape.name+deadLetterSuffix))
+		if err != nil {
+			log.Warn("create dead letter file failed", zap.Error(err))
+			return
+		}
+	}
+	_, err = deadLetterFile.Write(append(jsonData, '\n'))
+	if err != nil {
+		log.Warn("write dead letter failed", zap.Error(err))
+		return
+	}
+	DeadLetterCount.Add(1)
+}
+
+func closeDeadLetters() error {
+	deadLetterMutex.Lock()
+	defer deadLetterMutex.Unlock()
+	if deadLetterFile == nil {
+		return nil
+	}
+	err := deadLetterFile.Close()
+	deadLetterFile = nil
+	return err
+}
@@ -0,0 +1,220 @@
+package capture
+
+import (
+	"encoding/binary"
+
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/pkg/parser/charset"
+	"go.uber.org/zap"
+)
+
+const (
+	protocolVersion = 0x0a
+
+	clientConnectWithDB              = 0x00000008
+	clientSSL                        = 0x00000800
+	clientSecureConnection           = 0x00008000
+	clientPluginAuth                 = 0x00080000
+	clientConnectAttrs               = 0x00100000
+	clientPluginAuthLenEncClientData = 0x00200000
+	clientQueryAttributes            = 0x08000000
+)
+
+// session is what the handshake tells about a connection. It is only known
+// for connections seen from the start.
+type session struct {
+	User         string            `json:"user"`
+	DB           string            `json:"db"`
+	Charset      string            `json:"charset"`
+	Capabilities uint32            `json:"capabilities"`
+	Attrs        map[string]string `json:"attrs"`
+}
+
+// onGreeting starts the handshake phase when the server greeting is seen.
+func (w *mysqlWire) onGreeting(c *conn, payload []byte) {
+	w.handshake = true
+	log.Debug("server greeting",
+		zap.Int("conn", c.id),
+		zap.Int("router", c.router),
+		zap.String("version", string(readNullTerminated(payload[1:]))))
+}
+
+// onAuthResult ends the handshake phase once the server accepts or rejects
+// the client.
+func (w *mysqlWire) onAuthResult(c *conn, payload []byte) {
+	switch payload[0] {
+	case okPacket:
+		w.handshake = false
+		// a changed user goes on with the compression already in place
+		if w.changeUser != nil {
+			w.switchUser(c, true)
+			return
+		}
+		if c.session.Capabilities&(clientCompress|clientZstdCompressionAlgorithm) != 0 {
+			w.compress(c)
+		}
+	case errPacket:
+		w.handshake = false
+		w.switchUser(c, false)
+	}
+}
+
+// onHandshakeResponse parses HandshakeResponse41, or the SSLRequest that
+// precedes it on encrypted connections.
+func (w *mysqlWire) onHandshakeResponse(c *conn, payload []byte) {
+	if len(payload) < 32 {
+		return
+	}
+	capabilities := binary.LittleEndian.Uint32(payload[0:4])
+	if len(payload) == 32 && capabilities&clientSSL != 0 {
+		if c.proxied {
+			w.sslRequest = true
+			return
+		}
+		c.encrypted = true
+		EncryptedConnCount.Add(1)
+		log.Debug("conn switched to ssl",
+			zap.Int("conn", c.id),
+			zap.Int("router", c.router),
+			zap.String("from", c.from))
+		return
+	}
+
+	s := session{
+		Capabilities: capabilities,
+	}
+	if collation, err := charset.GetCollationByID(int(payload[8])); err == nil {
+		s.Charset = collation.CharsetName
+	}
+
+	data := payload[32:]
+	user := readNullTerminated(data)
+	s.User = string(user)
+	data = data[min(len(user)+1, len(data)):]
+
+	switch {
+	case capabilities&clientPluginAuthLenEncClientData != 0:
+		length, n := readLenEncInt(data)
+		data = data[min(n+int(length), len(data)):]
+	case capabilities&clientSecureConnection != 0:
+		if len(data) > 0 {
+			data = data[min(1+int(data[0]), len(data)):]
+		}
+	default:
+		auth := readNullTerminated(data)
+		data = data[min(len(auth)+1, len(data)):]
+	}
+
+	if capabilities&clientConnectWithDB != 0 {
+		db := readNullTerminated(data)
+		s.DB = string(db)
+		data = data[min(len(db)+1, len(data)):]
+	}
+	if capabilities&clientPluginAuth != 0 {
+		plugin := readNullTerminated(data)
+		data = data[min(len(plugin)+1, len(data)):]
+	}
+	if capabilities&clientConnectAttrs != 0 {
+		s.Attrs = readConnectAttrs(data)
+	}
+
+	c.session = s
+	log.Debug("conn handshake",
+		zap.Int("conn", c.id),
+		zap.Int("router", c.router),
+		zap.String("user", s.User),
+		zap.String("db", s.DB),
+		zap.String("program", s.Attrs["program_name"]))
+}
+
+// onChangeUser parses COM_CHANGE_USER. Its reply is awaited like the one of
+// the handshake, the session it asks for replaces the current one once the
+// server accepts it.
+func (w *mysqlWire) onChangeUser(c *conn, payload []byte) {
+	capabilities := c.session.Capabilities
+	s := session{
+		Charset:      c.session.Charset,
+		Capabilities: capabilities,
+		Attrs:        c.session.Attrs,
+	}
+
+	data := payload[1:]
+	user := readNullTerminated(data)
+	s.User = string(user)
+	data = data[min(len(user)+1, len(data)):]
+
+	// the capabilities are unknown for connections not seen from the start,
+	// every client since 4.1 sends the length of the auth response
+	if capabilities == 0 || capabilities&clientSecureConnection != 0 {
+		if len(data) > 0 {
+			data = data[min(1+int(data[0]), len(data)):]
+		}
+	} else {
+		auth := readNullTerminated(data)
+		data = data[min(len(auth)+1, len(data)):]
+	}
+
+	db := readNullTerminated(data)
+	s.DB = string(db)
+	data = data[min(len(db)+1, len(data)):]
+
+	if len(data) >= 2 {
+		if collation, err := charset.GetCollationByID(int(binary.LittleEndian.Uint16(data))); err == nil {
+			s.Charset = collation.CharsetName
+		}
+		data = data[2:]
+		if capabilities&clientPluginAuth != 0 {
+			plugin := readNullTerminated(data)
+			data = data[min(len(plugin)+1, len(data)):]
+		}
+		if capabilities&clientConnectAttrs != 0 && len(data) > 0 {
+			s.Attrs = readConnectAttrs(data)
+		}
+	}
+
+	w.changeUser = &s
+	w.handshake = true
+	log.Debug("conn change user",
+		zap.Int("conn", c.id),
+		zap.Int("router", c.router),
+		zap.String("user", s.User),
+		zap.String("db", s.DB))
+}
+
+// switchUser applies the session asked for by COM_CHANGE_USER once the
+// server has accepted it, which also drops the prepared statements. A change
+// whose reply was never seen is assumed to have succeeded when the next
+// command arrives.
+func (w *mysqlWire) switchUser(c *conn, ok bool) {
+	if w.changeUser == nil {
+		return
+	}
+	if ok {
+		c.session = *w.changeUser
+		clear(w.stmts)
+	}
+	w.changeUser = nil
+}
+
+func readConnectAttrs(data []byte) map[string]string {
+	total, n := readLenEncInt(data)
+	if n == 0 || len(data) < n+int(total) {
+		return nil
+	}
+	data = data[n : n+int(total)]
+
+	attrs := make(map[string]string)
+	for len(data) > 0 {
+		key, rest, ok := readLenEncString(data)
+		if !ok {
+			break
+		}
+		value, rest, ok := readLenEncString(rest)
+		if !ok {
+			break
+		}
+		attrs[key] = value
+		data = rest
+	}
+	return attrs
+}
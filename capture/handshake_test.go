@@ -0,0 +1,64 @@
+package capture
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestChangeUser(t *testing.T) {
+	before := session{
+		User:         "app",
+		DB:           "shop",
+		Charset:      "utf8mb4",
+		Capabilities: clientSecureConnection | clientPluginAuth | clientConnectWithDB,
+	}
+	changeUser := bytes.Join([][]byte{
+		{0x11},
+		[]byte("report\x00"),
+		append([]byte{20}, bytes.Repeat([]byte{0xaa}, 20)...),
+		[]byte("crm\x00"),
+		// latin1_swedish_ci
+		{0x08, 0x00},
+		[]byte("mysql_native_password\x00"),
+	}, nil)
+	after := session{
+		User:         "report",
+		DB:           "crm",
+		Charset:      "latin1",
+		Capabilities: before.Capabilities,
+	}
+
+	tests := []struct {
+		name string
+		// reply is the reply of the server, none when it was not seen
+		reply []byte
+		want  session
+		stmts int
+	}{
+		{name: "accepted", reply: []byte{okPacket, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}, want: after, stmts: 0},
+		{name: "rejected", reply: []byte{errPacket, 0x15, 0x04, '#', '2', '8', '0', '0', '0'}, want: before, stmts: 1},
+		{name: "reply not seen", want: after, stmts: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &conn{session: before}
+			w := newMySQLWire(0)
+			w.stmts[1] = &statement{id: 1}
+			w.onChangeUser(c, changeUser)
+			if !reflect.DeepEqual(c.session, before) {
+				t.Fatalf("got session %+v before the reply", c.session)
+			}
+			if tt.reply != nil {
+				w.onAuthResult(c, tt.reply)
+			} else {
+				// what the next command does
+				w.handshake = false
+				w.switchUser(c, true)
+			}
+			if !reflect.DeepEqual(c.session, tt.want) || len(w.stmts) != tt.stmts || w.handshake {
+				t.Errorf("got session %+v with %d statements, want %+v with %d", c.session, len(w.stmts), tt.want, tt.stmts)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package capture
+
+import (
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/pkg/parser"
+)
+
+// Importer writes statements read from server logs, instead of sniffed off
+// the wire, to a tape. They are classified, digested and redacted the same
+// way as captured ones.
+type Importer struct {
+	start  time.Time
+	parser *parser.Parser
+	// seqs numbers the records of each conn
+	seqs map[int]int
+}
+
+// Statement is one statement taken from a log, with what the log tells about
+// its execution.
+type Statement struct {
+	Time   time.Time
+	Conn   int
+	Client string
+	Server string
+	User   string
+	DB     string
+	Query  string
+	// Params are the values bound to the markers of Query, if any
+	Params       []any
+	ResponseTime time.Duration
+	AffectedRows uint64
+	ReturnedRows uint64
+	ResultBytes  uint64
+	ErrorCode    uint16
+	ProcessKeys  uint64
+	PlanDigest   string
+}
+
+func NewImporter(cfg TapeConfig) (*Importer, error) {
+	err := openTape(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Importer{
+		start:  time.Now(),
+		parser: parser.New(),
+		seqs:   make(map[int]int),
+	}, nil
+}
+
+// Import writes the records of s and returns the schema its connection is on
+// afterwards, which a USE changes. The statements of a multi-statement query
+// share a batch, and what the log tells about the execution goes to the
+// first one.
+func (i *Importer) Import(s *Statement) string {
+	t := s.Time.Local()
+	qr := newQueryRecord(
+		t.Format(timestampLayout), t, s.Conn, 0,
+		s.Client, s.Server, mysqlProtocol, session{User: s.User, DB: s.DB}, []string{s.Query}, i.parser)
+	qr.clean()
+	if len(qr.queries) == 0 {
+		return s.DB
+	}
+	records, err := qr.check()
+	if err != nil {
+		log.Warn("parse error",
+			parseErrorFields(qr.queries[0], err)...)
+		i.seqs[s.Conn]++
+		writeDeadLetter(&deadLetter{
+			Timestamp: qr.Timestamp,
+			Conn:      s.Conn,
+			Seq:       i.seqs[s.Conn],
+			Client:    s.Client,
+			Server:    s.Server,
+			DB:        s.DB,
+			Command:   "0x03",
+			Error:     err.Error(),
+			Raw:       append([]byte{0x03}, s.Query...),
+		})
+		return s.DB
+	}
+	if len(records) == 0 {
+		return s.DB
+	}
+
+	records[0].ResponseTime = s.ResponseTime.Microseconds()
+	records[0].AffectedRows = s.AffectedRows
+	records[0].ReturnedRows = s.ReturnedRows
+	records[0].ResultBytes = s.ResultBytes
+	records[0].ErrorCode = s.ErrorCode
+	records[0].ProcessKeys = s.ProcessKeys
+	records[0].PlanDigest = s.PlanDigest
+	if s.Params != nil {
+		records[0].Params = s.Params
+		records[0].redactParams()
+	}
+	db := s.DB
+	for _, record := range records {
+		i.seqs[s.Conn]++
+		record.Seq = i.seqs[s.Conn]
+		if len(records) > 1 {
+			record.Batch = records[0].Seq
+		}
+		record.DB = db
+		if record.use != "" && record.ErrorCode == 0 {
+			db = record.use
+		}
+		record.flush()
+	}
+	return db
+}
+
+// Close closes the tape and writes its summary.
+func (i *Importer) Close() error {
+	return finish(i.start, len(i.seqs))
+}
@@ -0,0 +1,65 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	okPacket    = 0x00
+	eofPacket   = 0xfe
+	errPacket   = 0xff
+	localInfile = 0xfb
+
+	maxPacketSize = 0xffffff
+
+	serverMoreResultsExists = 0x0008
+)
+
+// readLenEncInt decodes a length-encoded integer and returns the value and
+// the number of bytes it occupied, or 0 when data is truncated.
+func readLenEncInt(data []byte) (uint64, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+	switch data[0] {
+	case 0xfc:
+		if len(data) < 3 {
+			return 0, 0
+		}
+		return uint64(binary.LittleEndian.Uint16(data[1:3])), 3
+	case 0xfd:
+		if len(data) < 4 {
+			return 0, 0
+		}
+		return uint64(data[1]) | uint64(data[2])<<8 | uint64(data[3])<<16, 4
+	case 0xfe:
+		if len(data) < 9 {
+			return 0, 0
+		}
+		return binary.LittleEndian.Uint64(data[1:9]), 9
+	default:
+		return uint64(data[0]), 1
+	}
+}
+
+// isEOF reports whether payload is an EOF packet rather than a row or an
+// OK packet that reuses the 0xfe header.
+func isEOF(payload []byte) bool {
+	return len(payload) == 5 && payload[0] == eofPacket
+}
+
+func readNullTerminated(data []byte) []byte {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return data[:i]
+	}
+	return data
+}
+
+func readLenEncString(data []byte) (string, []byte, bool) {
+	length, n := readLenEncInt(data)
+	if n == 0 || len(data) < n+int(length) {
+		return "", nil, false
+	}
+	return string(data[n : n+int(length)]), data[n+int(length):], true
+}
@@ -1,7 +1,45 @@
 package capture
 
+import (
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// packet is a chunk of reassembled bytes of one direction of a conn.
 type packet struct {
-	seq     uint32
-	from    string
-	payload []byte
+	payload   []byte
+	timestamp time.Time
+	response  bool
+	// lost is set when bytes in front of the payload were never captured
+	lost bool
+}
+
+// networkAddresses returns the addresses of the innermost IPv4 or IPv6 layer,
+// so tunnelled traffic is attributed to the actual endpoints. IPv4-mapped
+// IPv6 addresses are folded into their IPv4 form, which keeps one client
+// under a single key whichever family it shows up with.
+func networkAddresses(p gopacket.Packet) (net.IP, net.IP, bool) {
+	var src, dst net.IP
+	for _, layer := range p.Layers() {
+		switch ip := layer.(type) {
+		case *layers.IPv4:
+			src, dst = ip.SrcIP, ip.DstIP
+		case *layers.IPv6:
+			src, dst = ip.SrcIP, ip.DstIP
+		}
+	}
+	if src == nil || dst == nil {
+		return nil, nil, false
+	}
+	return unmap(src), unmap(dst), true
+}
+
+func unmap(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
 }
@@ -0,0 +1,647 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/pkg/parser"
+	"github.com/pingcap/tidb/pkg/parser/mysql"
+	"go.uber.org/zap"
+)
+
+const (
+	pgProtocolVersion = 196608
+	pgSSLRequest      = 80877103
+	pgGSSENCRequest   = 80877104
+	pgCancelRequest   = 80877102
+
+	// pgError is the error_code of a statement PostgreSQL failed, the error
+	// itself is its SQLSTATE
+	pgError = 1
+)
+
+// pgStatement is a statement prepared by Parse, its $n markers rewritten to
+// ? in the order they appear. order holds the index of the value bound to
+// each of them.
+type pgStatement struct {
+	query string
+	order []int
+	types []uint32
+}
+
+// pgPortal is a statement bound to its values by Bind, stmt is nil when the
+// statement was prepared before the capture started.
+type pgPortal struct {
+	stmt   *pgStatement
+	params []any
+}
+
+// postgresWire is the PostgreSQL frontend/backend protocol 3.0. Simple
+// queries and executions of the extended protocol become records, the
+// startup message gives the session its user and database.
+type postgresWire struct {
+	frontend *pgStream
+	backend  *pgStream
+	parser   *parser.Parser
+	// untyped is set while the next message of the client is a startup
+	// message, which has no type byte
+	untyped bool
+	probed  bool
+	// sslRequested is set while the one byte answer to an SSLRequest or a
+	// GSSENCRequest is awaited
+	sslRequested bool
+	stmts        map[string]*pgStatement
+	portals      map[string]*pgPortal
+	// groups counts the records still waiting for their response of every
+	// Query or Sync not answered by ReadyForQuery yet, open those of the
+	// extended messages sent since the last Sync
+	groups []int
+	open   int
+}
+
+func newPostgresWire(maxQuerySize int) *postgresWire {
+	p := parser.New()
+	// standard SQL quoting: "identifiers" and no backslash escapes
+	p.SetSQLMode(mysql.ModeANSIQuotes | mysql.ModeNoBackslashEscapes)
+	return &postgresWire{
+		frontend: &pgStream{maxSize: maxQuerySize},
+		backend:  &pgStream{},
+		parser:   p,
+		stmts:    make(map[string]*pgStatement),
+		portals:  make(map[string]*pgPortal),
+	}
+}
+
+func (w *postgresWire) name() string {
+	return postgresProtocol
+}
+
+func (w *postgresWire) request(c *conn, p packet) {
+	if p.lost {
+		w.frontend.reset()
+	}
+	if !w.probed && len(p.payload) > 0 {
+		// connections seen from the start open with a startup message
+		w.probed = true
+		w.untyped = looksLikeStartup(p.payload)
+	}
+	w.frontend.buffer.Write(p.payload)
+	for {
+		typ, body, ok := w.frontend.next(w.untyped)
+		if !ok {
+			return
+		}
+		if w.untyped {
+			w.untyped = false
+			w.onStartup(c, body)
+			continue
+		}
+		if body == nil {
+			if typ == 'Q' || typ == 'P' {
+				log.Warn("query over max query size skipped",
+					zap.Int("conn", c.id),
+					zap.Int("router", c.router),
+					zap.String("from", c.from))
+				OversizedQueryCount.Add(1)
+			}
+			continue
+		}
+		c.setTimestamp(p.timestamp)
+		switch typ {
+		case 'Q':
+			w.onQuery(c, body, p)
+		case 'P':
+			w.onParse(body)
+		case 'B':
+			w.onBind(body)
+		case 'E':
+			w.onExecute(c, body, p)
+		case 'S':
+			w.groups = append(w.groups, w.open)
+			w.open = 0
+		case 'C':
+			w.onClose(body)
+		case 'X':
+			c.flushPending()
+		}
+	}
+}
+
+func (w *postgresWire) response(c *conn, p packet) {
+	if p.lost {
+		w.backend.reset()
+	}
+	w.backend.buffer.Write(p.payload)
+	if w.sslRequested {
+		answer, err := w.backend.buffer.ReadByte()
+		if err != nil {
+			return
+		}
+		w.sslRequested = false
+		if answer == 'S' || answer == 'G' {
+			c.encrypted = true
+			EncryptedConnCount.Add(1)
+			log.Debug("conn switched to ssl",
+				zap.Int("conn", c.id),
+				zap.Int("router", c.router),
+				zap.String("from", c.from))
+			return
+		}
+	}
+	for {
+		typ, body, ok := w.backend.next(false)
+		if !ok {
+			return
+		}
+		if typ == 'Z' {
+			w.onReady(c)
+			continue
+		}
+		if c.pending == nil {
+			continue
+		}
+		c.result.bytes += uint64(len(body)) + 5
+		switch typ {
+		case 'D':
+			c.result.returnedRows++
+		case 'C':
+			c.result.affectedRows += commandRows(body)
+			w.complete(c, p.timestamp)
+		case 'I', 's':
+			w.complete(c, p.timestamp)
+		case 'E':
+			c.pending.ErrorCode = pgError
+			c.pending.SQLState = errorField(body, 'C')
+			w.complete(c, p.timestamp)
+		}
+	}
+}
+
+// onStartup reads the startup message, or one of the requests that may come
+// in its place.
+func (w *postgresWire) onStartup(c *conn, body []byte) {
+	if len(body) < 4 {
+		return
+	}
+	switch binary.BigEndian.Uint32(body) {
+	case pgSSLRequest, pgGSSENCRequest:
+		// refused, the client goes on with a startup message in the clear
+		w.sslRequested = true
+		w.untyped = true
+	case pgProtocolVersion:
+		s := session{
+			Attrs: make(map[string]string),
+		}
+		fields := bytes.Split(body[4:], []byte{0})
+		for i := 0; i+1 < len(fields); i += 2 {
+			key, value := string(fields[i]), string(fields[i+1])
+			switch key {
+			case "":
+			case "user":
+				s.User = value
+			case "database":
+				s.DB = value
+			case "client_encoding":
+				s.Charset = value
+			default:
+				s.Attrs[key] = value
+			}
+		}
+		// the database defaults to the name of the user
+		if s.DB == "" {
+			s.DB = s.User
+		}
+		c.session = s
+	}
+}
+
+func (w *postgresWire) onQuery(c *conn, body []byte, p packet) {
+	query, _ := readCString(body)
+	records := w.check(c, query, p)
+	for _, qr := range records {
+		c.seq++
+		qr.Seq = c.seq
+		if len(records) > 1 {
+			qr.Batch = records[0].Seq
+		}
+		w.enqueue(c, qr)
+	}
+	// a simple query is answered by ReadyForQuery on its own
+	w.groups = append(w.groups, w.open+len(records))
+	w.open = 0
+}
+
+func (w *postgresWire) onParse(body []byte) {
+	name, rest := readCString(body)
+	query, rest := readCString(rest)
+	stmt := &pgStatement{}
+	stmt.query, stmt.order = rewriteMarkers(query)
+	if len(rest) >= 2 {
+		n := int(binary.BigEndian.Uint16(rest))
+		rest = rest[2:]
+		for i := 0; i < n && len(rest) >= 4; i++ {
+			stmt.types = append(stmt.types, binary.BigEndian.Uint32(rest))
+			rest = rest[4:]
+		}
+	}
+	w.stmts[name] = stmt
+}
+
+func (w *postgresWire) onBind(body []byte) {
+	portal, rest := readCString(body)
+	name, rest := readCString(rest)
+	stmt := w.stmts[name]
+	w.portals[portal] = &pgPortal{stmt: stmt}
+	if stmt == nil {
+		return
+	}
+
+	formats, rest, ok := readInt16s(rest)
+	if !ok || len(rest) < 2 {
+		return
+	}
+	n := int(binary.BigEndian.Uint16(rest))
+	rest = rest[2:]
+	values := make([]any, 0, n)
+	for i := 0; i < n; i++ {
+		if len(rest) < 4 {
+			return
+		}
+		length := int32(binary.BigEndian.Uint32(rest))
+		rest = rest[4:]
+		if length < 0 {
+			values = append(values, nil)
+			continue
+		}
+		if len(rest) < int(length) {
+			return
+		}
+		value := rest[:length]
+		rest = rest[length:]
+		format := uint16(0)
+		if len(formats) == 1 {
+			format = formats[0]
+		} else if i < len(formats) {
+			format = formats[i]
+		}
+		if format == 0 {
+			values = append(values, string(value))
+			continue
+		}
+		var oid uint32
+		if i < len(stmt.types) {
+			oid = stmt.types[i]
+		}
+		values = append(values, decodePGBinary(oid, value))
+	}
+
+	params := make([]any, len(stmt.order))
+	for i, index := range stmt.order {
+		if index >= 0 && index < len(values) {
+			params[i] = values[index]
+		}
+	}
+	w.portals[portal].params = params
+}
+
+func (w *postgresWire) onExecute(c *conn, body []byte, p packet) {
+	name, _ := readCString(body)
+	portal, ok := w.portals[name]
+	if !ok || portal.stmt == nil {
+		log.Debug("execute of an unknown statement",
+			zap.Int("conn", c.id),
+			zap.Int("router", c.router))
+		UnknownStatementCount.Add(1)
+		c.deadLetter(0, append([]byte{'E'}, body...), errors.New("unknown statement"))
+		return
+	}
+	records := w.check(c, portal.stmt.query, p)
+	if len(records) == 0 {
+		return
+	}
+	qr := records[0]
+	qr.Params = portal.params
+	qr.redactParams()
+	c.seq++
+	qr.Seq = c.seq
+	w.enqueue(c, qr)
+	w.open++
+}
+
+func (w *postgresWire) onClose(body []byte) {
+	if len(body) == 0 {
+		return
+	}
+	name, _ := readCString(body[1:])
+	switch body[0] {
+	case 'S':
+		delete(w.stmts, name)
+	case 'P':
+		delete(w.portals, name)
+	}
+}
+
+// check parses query into its records. The parser speaks MySQL, a statement
+// it can't read is recorded anyway, classified by its first keyword.
+func (w *postgresWire) check(c *conn, query string, p packet) []*QueryRecord {
+	qr := newQueryRecord(
+		c.lastPacketTimestamp, p.timestamp, c.id, c.router,
+		c.from, c.server, postgresProtocol, c.session, []string{query}, w.parser)
+	qr.clean()
+	if len(qr.queries) == 0 {
+		return nil
+	}
+	records, err := qr.check()
+	if err != nil {
+		log.Debug("parse error, classifying by keyword",
+			parseErrorFields(qr.queries[0], err)...)
+		qr.classify()
+		return []*QueryRecord{qr}
+	}
+	return records
+}
+
+func (w *postgresWire) enqueue(c *conn, qr *QueryRecord) {
+	if c.pending == nil {
+		c.pending = qr
+		return
+	}
+	c.queued = append(c.queued, qr)
+}
+
+// complete attaches the response to the pending record and moves on to the
+// next one. The statements of a simple query run one after the other, so
+// the next one starts now.
+func (w *postgresWire) complete(c *conn, t time.Time) {
+	batch := c.pending.Batch
+	c.complete(t)
+	if len(w.groups) > 0 && w.groups[0] > 0 {
+		w.groups[0]--
+	}
+	w.advance(c)
+	if c.pending != nil && batch != 0 && c.pending.Batch == batch {
+		c.pending.start = t
+	}
+}
+
+func (w *postgresWire) advance(c *conn) {
+	if len(c.queued) == 0 {
+		return
+	}
+	c.pending, c.queued = c.queued[0], c.queued[1:]
+}
+
+// onReady flushes the records of the oldest Query or Sync that got no
+// response, the server skips what follows an error until then.
+func (w *postgresWire) onReady(c *conn) {
+	if len(w.groups) == 0 {
+		return
+	}
+	n := w.groups[0]
+	w.groups = w.groups[1:]
+	for ; n > 0 && c.pending != nil; n-- {
+		c.pending.flush()
+		c.pending = nil
+		c.result = result{}
+		w.advance(c)
+	}
+}
+
+// pgStream splits the reassembled bytes of one direction of a connection
+// into PostgreSQL messages.
+type pgStream struct {
+	buffer bytes.Buffer
+	// maxSize caps the body of a message, 0 means no limit
+	maxSize int
+	// discard is what is left of a message over maxSize being dropped
+	discard int
+	dropped byte
+}
+
+func (s *pgStream) reset() {
+	s.buffer.Reset()
+	s.discard = 0
+}
+
+// next pops the next complete message off the buffer, untyped for the
+// startup messages that have no type byte. A message over maxSize is
+// skipped without being buffered and comes back with a nil body once all of
+// it went by. The body is only valid until the next write to the stream.
+func (s *pgStream) next(untyped bool) (byte, []byte, bool) {
+	if s.discard > 0 {
+		n := min(s.discard, s.buffer.Len())
+		s.buffer.Next(n)
+		s.discard -= n
+		if s.discard > 0 {
+			return 0, nil, false
+		}
+		return s.dropped, nil, true
+	}
+	header := 5
+	if untyped {
+		header = 4
+	}
+	data := s.buffer.Bytes()
+	if len(data) < header {
+		return 0, nil, false
+	}
+	var typ byte
+	if !untyped {
+		typ = data[0]
+	}
+	length := int(binary.BigEndian.Uint32(data[header-4:]))
+	if length < 4 || !untyped && !isMessageType(typ) {
+		// not a message boundary, nothing buffered can be trusted
+		s.reset()
+		return 0, nil, false
+	}
+	size := length - 4
+	if s.maxSize > 0 && size > s.maxSize {
+		s.buffer.Next(header)
+		s.discard = size
+		s.dropped = typ
+		return s.next(untyped)
+	}
+	if len(data) < header+size {
+		return 0, nil, false
+	}
+	return typ, s.buffer.Next(header + size)[header:], true
+}
+
+// looksLikeStartup reports whether payload opens with a startup message or
+// one of the requests sent in its place.
+func looksLikeStartup(payload []byte) bool {
+	if len(payload) < 8 {
+		return false
+	}
+	switch binary.BigEndian.Uint32(payload[4:8]) {
+	case pgProtocolVersion, pgSSLRequest, pgGSSENCRequest, pgCancelRequest:
+		return true
+	}
+	return false
+}
+
+func readCString(data []byte) (string, []byte) {
+	value := readNullTerminated(data)
+	return string(value), data[min(len(value)+1, len(data)):]
+}
+
+func readInt16s(data []byte) ([]uint16, []byte, bool) {
+	if len(data) < 2 {
+		return nil, data, false
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) < 2*n {
+		return nil, data, false
+	}
+	values := make([]uint16, n)
+	for i := range values {
+		values[i] = binary.BigEndian.Uint16(data[2*i:])
+	}
+	return values, data[2*n:], true
+}
+
+// commandRows reads the rows changed from a CommandComplete tag such as
+// INSERT 0 5 or UPDATE 3, rows returned are counted from the DataRows.
+func commandRows(body []byte) uint64 {
+	tag, _ := readCString(body)
+	fields := strings.Fields(tag)
+	if len(fields) < 2 {
+		return 0
+	}
+	switch fields[0] {
+	case "INSERT", "UPDATE", "DELETE", "MERGE", "COPY":
+		var rows uint64
+		_, _ = fmt.Sscan(fields[len(fields)-1], &rows)
+		return rows
+	}
+	return 0
+}
+
+// errorField finds a field of an ErrorResponse, e.g. C for the SQLSTATE.
+func errorField(body []byte, field byte) string {
+	for len(body) > 0 && body[0] != 0 {
+		code := body[0]
+		var value string
+		value, body = readCString(body[1:])
+		if code == field {
+			return value
+		}
+	}
+	return ""
+}
+
+// rewriteMarkers turns the $n markers of query into ? and returns the index
+// of the value each of them stands for. Markers inside literals, quoted
+// identifiers and comments are left alone.
+func rewriteMarkers(query string) (string, []int) {
+	var b strings.Builder
+	var order []int
+	for i := 0; i < len(query); {
+		switch ch := query[i]; {
+		case ch == '\'' || ch == '"':
+			end := strings.IndexByte(query[i+1:], ch)
+			if end < 0 {
+				b.WriteString(query[i:])
+				return b.String(), order
+			}
+			b.WriteString(query[i : i+end+2])
+			i += end + 2
+		case ch == '-' && strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			b.WriteString(query[i : i+end])
+			i += end
+		case ch == '/' && strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				b.WriteString(query[i:])
+				return b.String(), order
+			}
+			b.WriteString(query[i : i+end+4])
+			i += end + 4
+		case ch == '$':
+			j := i + 1
+			for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+				j++
+			}
+			if j > i+1 {
+				// $0 and numbers past an int are no markers, they are kept
+				// as they are
+				var n int
+				_, err := fmt.Sscan(query[i+1:j], &n)
+				if err == nil && n >= 1 {
+					order = append(order, n-1)
+					b.WriteByte('?')
+				} else {
+					b.WriteString(query[i:j])
+				}
+				i = j
+				continue
+			}
+			// a dollar quoted string, $$...$$ or $tag$...$tag$
+			for j < len(query) && (query[j] == '_' || isLetter(query[j]) || query[j] >= '0' && query[j] <= '9') {
+				j++
+			}
+			if j < len(query) && query[j] == '$' {
+				tag := query[i : j+1]
+				end := strings.Index(query[j+1:], tag)
+				if end < 0 {
+					b.WriteString(query[i:])
+					return b.String(), order
+				}
+				b.WriteString(query[i : j+1+end+len(tag)])
+				i = j + 1 + end + len(tag)
+				continue
+			}
+			b.WriteByte(ch)
+			i++
+		default:
+			b.WriteByte(ch)
+			i++
+		}
+	}
+	return b.String(), order
+}
+
+// isMessageType reports whether typ may start a message, ParseComplete,
+// BindComplete and CloseComplete are the only ones that aren't letters.
+func isMessageType(typ byte) bool {
+	return isLetter(typ) || typ >= '1' && typ <= '3'
+}
+
+func isLetter(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z'
+}
+
+// decodePGBinary decodes a value bound in binary format by the type the
+// statement was prepared with, values of other types are kept as bytea
+// hex.
+func decodePGBinary(oid uint32, data []byte) any {
+	switch {
+	case oid == 16 && len(data) == 1:
+		return data[0] != 0
+	case oid == 21 && len(data) == 2:
+		return int64(int16(binary.BigEndian.Uint16(data)))
+	case oid == 23 && len(data) == 4:
+		return int64(int32(binary.BigEndian.Uint32(data)))
+	case oid == 20 && len(data) == 8:
+		return int64(binary.BigEndian.Uint64(data))
+	case oid == 700 && len(data) == 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	case oid == 701 && len(data) == 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data))
+	case oid == 25 || oid == 1042 || oid == 1043 || oid == 19:
+		return string(data)
+	}
+	return fmt.Sprintf(`\x%x`, data)
+}
@@ -0,0 +1,195 @@
+package capture
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestRewriteMarkers(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+		order []int
+	}{
+		{name: "no markers", query: "select 1", want: "select 1"},
+		{name: "in order", query: "select * from t where a = $1 and b = $2", want: "select * from t where a = ? and b = ?", order: []int{0, 1}},
+		{name: "out of order and repeated", query: "update t set a = $2 where id = $1 or parent = $1", want: "update t set a = ? where id = ? or parent = ?", order: []int{1, 0, 0}},
+		{name: "two digits", query: "values ($10, $9)", want: "values (?, ?)", order: []int{9, 8}},
+		{name: "string literal", query: "select '$1', $1", want: "select '$1', ?", order: []int{0}},
+		{name: "quoted identifier", query: `select "$1" from t where a = $1`, want: `select "$1" from t where a = ?`, order: []int{0}},
+		{name: "line comment", query: "select $1 -- and $2\nfrom t", want: "select ? -- and $2\nfrom t", order: []int{0}},
+		{name: "block comment", query: "select /* $1 */ $1", want: "select /* $1 */ ?", order: []int{0}},
+		{name: "dollar quoted", query: "select $$it's $1$$, $1", want: "select $$it's $1$$, ?", order: []int{0}},
+		{name: "tagged dollar quoted", query: "select $fn$ $1 $$ $fn$ || $1", want: "select $fn$ $1 $$ $fn$ || ?", order: []int{0}},
+		{name: "unterminated literal", query: "select $1, 'abc", want: "select ?, 'abc", order: []int{0}},
+		{name: "lone dollar", query: "select a$ from t", want: "select a$ from t"},
+		{name: "zero is no marker", query: "select $0, $1", want: "select $0, ?", order: []int{0}},
+		{name: "overflowing number is no marker", query: "select $99999999999999999999", want: "select $99999999999999999999"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, order := rewriteMarkers(tt.query)
+			if got != tt.want || !reflect.DeepEqual(order, tt.order) {
+				t.Errorf("got %q %v, want %q %v", got, order, tt.want, tt.order)
+			}
+		})
+	}
+}
+
+// pgMessage frames body as a message of type typ, untyped when typ is 0.
+func pgMessage(typ byte, body string) []byte {
+	var m []byte
+	if typ != 0 {
+		m = append(m, typ)
+	}
+	m = binary.BigEndian.AppendUint32(m, uint32(len(body)+4))
+	return append(m, body...)
+}
+
+func TestPGStreamNext(t *testing.T) {
+	type popped struct {
+		typ  byte
+		body string
+		// skipped is set for a body over maxSize
+		skipped bool
+	}
+	query := pgMessage('Q', "select 1\x00")
+	startup := pgMessage(0, "\x00\x03\x00\x00user\x00app\x00\x00")
+
+	tests := []struct {
+		name    string
+		maxSize int
+		untyped bool
+		chunks  [][]byte
+		want    []popped
+	}{
+		{
+			name:   "query",
+			chunks: [][]byte{query},
+			want:   []popped{{typ: 'Q', body: "select 1\x00"}},
+		},
+		{
+			name:   "message split across chunks",
+			chunks: [][]byte{query[:3], query[3:8], query[8:]},
+			want:   []popped{{typ: 'Q', body: "select 1\x00"}},
+		},
+		{
+			name:   "pipelined messages",
+			chunks: [][]byte{append(append(pgMessage('P', "\x00select 1\x00\x00\x00"), pgMessage('E', "\x00\x00\x00\x00\x00")...), pgMessage('S', "")...)},
+			want:   []popped{{typ: 'P', body: "\x00select 1\x00\x00\x00"}, {typ: 'E', body: "\x00\x00\x00\x00\x00"}, {typ: 'S'}},
+		},
+		{
+			name:   "backend messages with digits",
+			chunks: [][]byte{append(append(pgMessage('1', ""), pgMessage('2', "")...), pgMessage('Z', "I")...)},
+			want:   []popped{{typ: '1'}, {typ: '2'}, {typ: 'Z', body: "I"}},
+		},
+		{
+			name:    "startup message",
+			untyped: true,
+			chunks:  [][]byte{startup},
+			want:    []popped{{body: "\x00\x03\x00\x00user\x00app\x00\x00"}},
+		},
+		{
+			name:   "not a message boundary",
+			chunks: [][]byte{append([]byte{0xff, 0, 0, 0, 5, 0}, query...)},
+			want:   nil,
+		},
+		{
+			name:   "length below its own size",
+			chunks: [][]byte{{'Q', 0, 0, 0, 2}},
+			want:   nil,
+		},
+		{
+			name:    "oversized message is skipped",
+			maxSize: 4,
+			chunks:  [][]byte{append(query, pgMessage('S', "")...)},
+			want:    []popped{{typ: 'Q', skipped: true}, {typ: 'S'}},
+		},
+		{
+			name:    "oversized message arriving in pieces",
+			maxSize: 4,
+			chunks:  [][]byte{query[:7], query[7:], pgMessage('S', "")},
+			want:    []popped{{typ: 'Q', skipped: true}, {typ: 'S'}},
+		},
+		{
+			name:    "message at the limit is kept",
+			maxSize: 9,
+			chunks:  [][]byte{query},
+			want:    []popped{{typ: 'Q', body: "select 1\x00"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &pgStream{maxSize: tt.maxSize}
+			var got []popped
+			for _, chunk := range tt.chunks {
+				s.buffer.Write(chunk)
+				for {
+					typ, body, ok := s.next(tt.untyped)
+					if !ok {
+						break
+					}
+					got = append(got, popped{typ: typ, body: string(body), skipped: body == nil})
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// bindMessage builds the body of a Bind of the unnamed statement to the
+// unnamed portal with values in text format, a nil value is a NULL.
+func bindMessage(values ...[]byte) []byte {
+	m := []byte{0, 0, 0, 0}
+	m = binary.BigEndian.AppendUint16(m, uint16(len(values)))
+	for _, v := range values {
+		if v == nil {
+			m = binary.BigEndian.AppendUint32(m, math.MaxUint32)
+			continue
+		}
+		m = binary.BigEndian.AppendUint32(m, uint32(len(v)))
+		m = append(m, v...)
+	}
+	return binary.BigEndian.AppendUint16(m, 0)
+}
+
+func TestOnBind(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  string
+		values [][]byte
+		want   []any
+	}{
+		{name: "in order", query: "select $1, $2", values: [][]byte{[]byte("1"), []byte("a")}, want: []any{"1", "a"}},
+		{name: "out of order and repeated", query: "select $2, $1, $2", values: [][]byte{[]byte("1"), []byte("a")}, want: []any{"a", "1", "a"}},
+		{name: "null", query: "select $1", values: [][]byte{nil}, want: []any{nil}},
+		{name: "missing value", query: "select $1, $3", values: [][]byte{[]byte("1")}, want: []any{"1", nil}},
+		{name: "zero marker", query: "select $0, $1", values: [][]byte{[]byte("1")}, want: []any{"1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newPostgresWire(0)
+			query, order := rewriteMarkers(tt.query)
+			w.stmts[""] = &pgStatement{query: query, order: order}
+			w.onBind(bindMessage(tt.values...))
+			portal := w.portals[""]
+			if portal == nil || !reflect.DeepEqual(portal.params, tt.want) {
+				t.Errorf("got portal %+v, want params %v", portal, tt.want)
+			}
+		})
+	}
+
+	t.Run("negative index", func(t *testing.T) {
+		w := newPostgresWire(0)
+		w.stmts[""] = &pgStatement{query: "select ?", order: []int{-1}}
+		w.onBind(bindMessage([]byte("1")))
+		if params := w.portals[""].params; !reflect.DeepEqual(params, []any{nil}) {
+			t.Errorf("got params %v, want [<nil>]", params)
+		}
+	})
+}
@@ -0,0 +1,22 @@
+package capture
+
+const (
+	mysqlProtocol    = "mysql"
+	postgresProtocol = "postgres"
+)
+
+// protocol turns the reassembled bytes of a conn into query records. The
+// conn holds what every protocol shares: the records waiting for their
+// response, the session and the numbering of the records.
+type protocol interface {
+	name() string
+	request(c *conn, p packet)
+	response(c *conn, p packet)
+}
+
+func newProtocol(name string, maxQuerySize int) protocol {
+	if name == postgresProtocol {
+		return newPostgresWire(maxQuerySize)
+	}
+	return newMySQLWire(maxQuerySize)
+}
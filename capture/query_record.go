@@ -1,10 +1,11 @@
 package capture
 
 import (
-	"bufio"
 	"encoding/json"
+	"reflect"
 	"strings"
-	"sync"
+	"time"
+	"unicode"
 
 	"github.com/pingcap/log"
 	"github.com/pingcap/tidb/pkg/parser"
@@ -12,115 +13,322 @@ import (
 	"go.uber.org/zap"
 )
 
-var writerMutex sync.Mutex
-var bufWriter *bufio.Writer
+// timestampLayout is the format of QueryRecord.Timestamp
+const timestampLayout = "2006-01-02 15:04:05.000000"
 
 type QueryRecord struct {
 	Timestamp string `json:"timestamp"`
 	Conn      int    `json:"conn"`
-	router    int
-	from      string
-	Type      string `json:"type"`
-	Digest    string `json:"digest"`
-	Text      string `json:"text"`
-	parser    *parser.Parser
-	queries   []string
+	Seq       int    `json:"seq"`
+	// Batch is the seq of the first statement of a multi-statement query,
+	// shared by all its statements, and 0 for a single statement
+	Batch        int `json:"batch"`
+	router       int
+	Client       string `json:"client"`
+	Server       string `json:"server"`
+	Protocol     string `json:"protocol"`
+	Type         string `json:"type"`
+	Subtype      string `json:"subtype"`
+	Digest       string `json:"digest"`
+	Text         string `json:"text"`
+	Params       []any  `json:"params"`
+	ResponseTime int64  `json:"response_time"`
+	AffectedRows uint64 `json:"affected_rows"`
+	ReturnedRows uint64 `json:"returned_rows"`
+	ResultBytes  uint64 `json:"result_bytes"`
+	ErrorCode    uint16 `json:"error_code"`
+	// SQLState is the error of a PostgreSQL statement, whose error_code is
+	// only set to 1
+	SQLState string `json:"sqlstate,omitempty"`
+	// ProcessKeys and PlanDigest are only known for statements imported from
+	// the TiDB slow log
+	ProcessKeys uint64 `json:"process_keys,omitempty"`
+	PlanDigest  string `json:"plan_digest,omitempty"`
+	session
+	start   time.Time
+	use     string
+	parser  *parser.Parser
+	queries []string
+	// redactedParams are the indexes of the bound values to redact
+	redactedParams []int
 }
 
 func newQueryRecord(
-	timestamp string, conn, router int, from string, queries []string, parser *parser.Parser) *QueryRecord {
+	timestamp string, start time.Time, conn, router int, from string, server string, protocol string, session session, queries []string, parser *parser.Parser) *QueryRecord {
 	return &QueryRecord{
 		Timestamp: timestamp,
+		start:     start,
 		Conn:      conn,
 		router:    router,
-		from:      from,
+		Client:    from,
+		Server:    server,
+		Protocol:  protocol,
+		session:   session,
 		queries:   queries,
 		parser:    parser,
 	}
 }
 
-func (qr *QueryRecord) check() error {
+// check parses the query and returns one record per statement, none for a
+// query of comments only. The
+// statements of a multi-statement query share the session, timestamp and
+// start of qr.
+func (qr *QueryRecord) check() ([]*QueryRecord, error) {
 	query := qr.queries[0]
 	stmts, _, err := qr.parser.Parse(query, "utf-8", "")
 	if err != nil {
 		ParseErrorCount.Add(1)
-		return err
-	}
-	_, digest := parser.NormalizeDigest(query)
-	for _, stmt := range stmts {
-		switch stmt.(type) {
-		case *ast.SelectStmt:
-			qr.Type = "select"
-		case *ast.InsertStmt:
-			qr.Type = "insert"
-		case *ast.UpdateStmt:
-			qr.Type = "update"
-		case *ast.DeleteStmt:
-			qr.Type = "delete"
-		case *ast.CommitStmt:
-			qr.Type = "commit"
-		case *ast.RollbackStmt:
-			qr.Type = "rollback"
-		case *ast.AlterTableStmt,
-			*ast.AlterSequenceStmt,
-			*ast.AlterPlacementPolicyStmt,
-			*ast.AlterResourceGroupStmt,
-			*ast.CreateDatabaseStmt,
-			*ast.CreateIndexStmt,
-			*ast.CreateTableStmt,
-			*ast.CreateViewStmt,
-			*ast.CreateSequenceStmt,
-			*ast.CreatePlacementPolicyStmt,
-			*ast.CreateResourceGroupStmt,
-			*ast.DropDatabaseStmt,
-			*ast.DropIndexStmt,
-			*ast.DropTableStmt,
-			*ast.DropSequenceStmt,
-			*ast.DropPlacementPolicyStmt,
-			*ast.DropResourceGroupStmt,
-			*ast.OptimizeTableStmt,
-			*ast.RenameTableStmt,
-			*ast.TruncateTableStmt,
-			*ast.RepairTableStmt:
-			qr.Type = "ddl"
-		case *ast.AnalyzeTableStmt:
-			qr.Type = "analyze"
-		default:
-			qr.Type = "others"
+		return nil, err
+	}
+	// a query of comments only has no statement to record
+	if len(stmts) == 0 {
+		return nil, nil
+	}
+	records := make([]*QueryRecord, 0, len(stmts))
+	for i, stmt := range stmts {
+		record := qr
+		if i > 0 {
+			copied := *qr
+			record = &copied
+		}
+		record.Type, record.Subtype, record.use = statementType(stmt)
+		text := strings.TrimSuffix(strings.TrimSpace(stmt.Text()), ";")
+		record.Text = text + ";"
+		if len(stmts) == 1 {
+			text = query
+		}
+		_, digest := parser.NormalizeDigest(text)
+		record.Digest = digest.String()
+		if redaction != nil {
+			record.redact(stmt, text)
 		}
-		qr.Digest = digest.String()
 		TotalQueryCount.Add(1)
-		qr.Text += stmt.Text() + ";"
+		records = append(records, record)
 	}
-	return nil
+	return records, nil
 }
 
-func (qr *QueryRecord) flush() {
-
-	jsonData, err := json.Marshal(qr)
+// redact rewrites the text of the record with the redaction policy. Should
+// the statement fail to restore, the literals are masked on the text instead.
+func (qr *QueryRecord) redact(stmt ast.StmtNode, text string) {
+	redacted, params, err := redaction.redact(stmt)
+	qr.redactedParams = params
 	if err != nil {
-		log.Warn("marshal failed", zap.Error(err))
+		log.Warn("redact failed, masking all literals", zap.Error(err))
+		qr.Text = parser.Normalize(text, "ON") + ";"
 		return
 	}
+	if redacted != "" {
+		qr.Text = redacted + ";"
+	}
+}
 
-	writerMutex.Lock()
-	defer writerMutex.Unlock()
+// parseErrorFields are the log fields of a query that failed to parse. The
+// query and the parser error both quote its literals, so with a redaction
+// policy in effect only the normalized query is logged.
+func parseErrorFields(query string, err error) []zap.Field {
+	if redaction != nil {
+		return []zap.Field{zap.String("sql", parser.Normalize(query, "ON"))}
+	}
+	return []zap.Field{zap.String("sql", query), zap.String("err", err.Error())}
+}
 
-	if bufWriter == nil {
-		log.Fatal("buffer writer not initialized")
+// statementType classifies a statement into a broad type and a subtype naming
+// the statement itself, e.g. ddl / create table or transaction / savepoint.
+// For USE it also returns the database switched to.
+func statementType(stmt ast.StmtNode) (typ, subtype, use string) {
+	subtype = statementName(stmt)
+	switch s := stmt.(type) {
+	case *ast.SelectStmt:
+		return "select", subtype, ""
+	case *ast.SetOprStmt:
+		return "select", "union", ""
+	case *ast.InsertStmt:
+		if s.IsReplace {
+			subtype = "replace"
+		}
+		return "insert", subtype, ""
+	case *ast.UpdateStmt:
+		return "update", subtype, ""
+	case *ast.DeleteStmt:
+		return "delete", subtype, ""
+	case *ast.BeginStmt,
+		*ast.CommitStmt,
+		*ast.RollbackStmt,
+		*ast.SavepointStmt,
+		*ast.ReleaseSavepointStmt:
+		return "transaction", subtype, ""
+	case *ast.UseStmt:
+		return "session", subtype, s.DBName
+	case *ast.SetStmt,
+		*ast.SetRoleStmt,
+		*ast.LockTablesStmt,
+		*ast.UnlockTablesStmt,
+		*ast.PrepareStmt,
+		*ast.ExecuteStmt,
+		*ast.DeallocateStmt,
+		*ast.KillStmt:
+		return "session", subtype, ""
+	case *ast.ShowStmt,
+		*ast.ExplainStmt,
+		*ast.ExplainForStmt,
+		*ast.TraceStmt:
+		return "metadata", subtype, ""
+	case *ast.CreateUserStmt:
+		if s.IsCreateRole {
+			subtype = "create role"
+		}
+		return "dcl", subtype, ""
+	case *ast.SetPwdStmt:
+		return "dcl", "set password", ""
+	case *ast.GrantStmt,
+		*ast.GrantRoleStmt,
+		*ast.RevokeStmt,
+		*ast.RevokeRoleStmt,
+		*ast.AlterUserStmt,
+		*ast.DropUserStmt,
+		*ast.RenameUserStmt,
+		*ast.SetDefaultRoleStmt:
+		return "dcl", subtype, ""
+	case *ast.CallStmt,
+		*ast.ProcedureInfo,
+		*ast.DropProcedureStmt:
+		return "procedure", subtype, ""
+	case *ast.LoadDataStmt,
+		*ast.ImportIntoStmt:
+		return "bulkload", subtype, ""
+	case *ast.AlterTableStmt,
+		*ast.AlterSequenceStmt,
+		*ast.AlterPlacementPolicyStmt,
+		*ast.AlterResourceGroupStmt,
+		*ast.CreateDatabaseStmt,
+		*ast.CreateIndexStmt,
+		*ast.CreateTableStmt,
+		*ast.CreateViewStmt,
+		*ast.CreateSequenceStmt,
+		*ast.CreatePlacementPolicyStmt,
+		*ast.CreateResourceGroupStmt,
+		*ast.DropDatabaseStmt,
+		*ast.DropIndexStmt,
+		*ast.DropTableStmt,
+		*ast.DropSequenceStmt,
+		*ast.DropPlacementPolicyStmt,
+		*ast.DropResourceGroupStmt,
+		*ast.OptimizeTableStmt,
+		*ast.RenameTableStmt,
+		*ast.TruncateTableStmt,
+		*ast.RepairTableStmt:
+		return "ddl", subtype, ""
+	case *ast.AnalyzeTableStmt:
+		return "analyze", subtype, ""
+	default:
+		return "others", subtype, ""
 	}
-	buffer := make([]byte, len(jsonData)+1)
-	copy(buffer, jsonData)
-	buffer[len(jsonData)] = '\n'
-	_, err = bufWriter.Write(buffer)
-	if err != nil {
-		log.Warn("write failed", zap.Error(err))
+}
+
+// statementName turns the parser node name into words, so CreateTableStmt
+// becomes "create table".
+func statementName(stmt ast.StmtNode) string {
+	name := reflect.TypeOf(stmt).Elem().Name()
+	name = strings.TrimSuffix(strings.TrimSuffix(name, "Stmt"), "Info")
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// keywordTypes classifies the statements the parser can't read by their first
+// keyword.
+var keywordTypes = map[string]string{
+	"select":     "select",
+	"with":       "select",
+	"values":     "select",
+	"table":      "select",
+	"insert":     "insert",
+	"update":     "update",
+	"delete":     "delete",
+	"merge":      "update",
+	"begin":      "transaction",
+	"start":      "transaction",
+	"commit":     "transaction",
+	"end":        "transaction",
+	"abort":      "transaction",
+	"rollback":   "transaction",
+	"savepoint":  "transaction",
+	"release":    "transaction",
+	"set":        "session",
+	"reset":      "session",
+	"discard":    "session",
+	"prepare":    "session",
+	"execute":    "session",
+	"deallocate": "session",
+	"lock":       "session",
+	"listen":     "session",
+	"unlisten":   "session",
+	"notify":     "session",
+	"show":       "metadata",
+	"explain":    "metadata",
+	"grant":      "dcl",
+	"revoke":     "dcl",
+	"call":       "procedure",
+	"do":         "procedure",
+	"copy":       "bulkload",
+	"create":     "ddl",
+	"alter":      "ddl",
+	"drop":       "ddl",
+	"truncate":   "ddl",
+	"comment":    "ddl",
+	"analyze":    "analyze",
+	"vacuum":     "analyze",
+}
+
+// classify fills in a record the parser could not read, so a statement in a
+// dialect it doesn't know still counts in the workload. The subtype is the
+// first keyword, and with redaction on every literal and bound value is
+// masked.
+func (qr *QueryRecord) classify() {
+	text := strings.TrimSuffix(strings.TrimSpace(qr.queries[0]), ";")
+	fields := strings.Fields(strings.ToLower(text))
+	keyword := ""
+	if len(fields) > 0 {
+		keyword = strings.TrimLeft(fields[0], "(")
+	}
+	qr.Type = keywordTypes[keyword]
+	if qr.Type == "" {
+		qr.Type = "others"
+	}
+	qr.Subtype = keyword
+	qr.Text = text + ";"
+	_, digest := parser.NormalizeDigest(text)
+	qr.Digest = digest.String()
+	if redaction != nil {
+		qr.Text = parser.Normalize(text, "ON") + ";"
+		for i := range strings.Count(text, "?") {
+			qr.redactedParams = append(qr.redactedParams, i)
+		}
+	}
+	TotalQueryCount.Add(1)
+}
+
+func (qr *QueryRecord) flush() {
+	if sampling != nil && !sampling.keep(qr) {
+		SampledQueryCount.Add(1)
 		return
 	}
-	err = bufWriter.Flush()
+
+	jsonData, err := json.Marshal(qr)
 	if err != nil {
-		log.Warn("flush buffer failed", zap.Error(err))
+		log.Warn("marshal failed", zap.Error(err))
+		return
+	}
+	if tape == nil {
+		log.Fatal("tape writer not initialized")
 	}
+	tape.enqueue(append(jsonData, '\n'))
 }
 
 func (qr *QueryRecord) clean() {
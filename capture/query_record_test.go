@@ -0,0 +1,45 @@
+package capture
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb/pkg/parser"
+)
+
+func TestQueryRecordCheck(t *testing.T) {
+	tests := []struct {
+		query string
+		// want are the type and text of every record
+		want  [][2]string
+		error bool
+	}{
+		{query: "select 1", want: [][2]string{{"select", "select 1;"}}},
+		{query: "select 1; update t set a = 1;", want: [][2]string{{"select", "select 1;"}, {"update", "update t set a = 1;"}}},
+		{query: "/* ping */", want: nil},
+		{query: "-- nothing to run\n", want: nil},
+		{query: "/* a */ ; /* b */", want: nil},
+		{query: "selec 1", error: true},
+	}
+	for _, tt := range tests {
+		qr := newQueryRecord("", time.Time{}, 1, 0, "", "", mysqlProtocol, session{}, []string{tt.query}, parser.New())
+		records, err := qr.check()
+		if tt.error {
+			if err == nil {
+				t.Errorf("%q: got %d records, want an error", tt.query, len(records))
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", tt.query, err)
+		}
+		var got [][2]string
+		for _, r := range records {
+			got = append(got, [2]string{r.Type, r.Text})
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package capture
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Recorder writes connections whose bytes are handed over directly, instead
+// of sniffed off the wire, to a tape. The proxy records through it.
+type Recorder struct {
+	connManager *connManager
+	start       time.Time
+}
+
+func NewRecorder(cfg TapeConfig, querySize int) (*Recorder, error) {
+	err := checkLimits(limit{maxQuerySize, int64(querySize)})
+	if err != nil {
+		return nil, err
+	}
+	err = openTape(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cm := newConnManager(nil, querySize*1024*1024)
+	cm.proxied = true
+	return &Recorder{
+		connManager: cm,
+		start:       time.Now(),
+	}, nil
+}
+
+// Open starts recording a connection from client to server.
+func (r *Recorder) Open(client string, server string) *RecordedConn {
+	return &RecordedConn{
+		conn: r.connManager.newConn(client, server, mysqlProtocol),
+	}
+}
+
+// Close waits for every recorded connection to be flushed and closes the
+// tape. Connections must be closed before.
+func (r *Recorder) Close() error {
+	r.connManager.close()
+	return finish(r.start, r.connManager.globalID)
+}
+
+// RecordedConn feeds the bytes of one connection to its conn. Request and
+// Response may be called from different goroutines as long as a response is
+// recorded after the request it answers.
+type RecordedConn struct {
+	conn      *conn
+	closeOnce sync.Once
+}
+
+// Request records bytes the client sent at t.
+func (rc *RecordedConn) Request(data []byte, t time.Time) {
+	rc.push(data, t, false)
+}
+
+// Response records bytes the server sent at t.
+func (rc *RecordedConn) Response(data []byte, t time.Time) {
+	rc.push(data, t, true)
+}
+
+func (rc *RecordedConn) push(data []byte, t time.Time, response bool) {
+	rc.conn.packetChan <- &packet{
+		payload:   slices.Clone(data),
+		timestamp: t,
+		response:  response,
+	}
+}
+
+// Close lets the conn finish the bytes it has, nothing may be recorded
+// afterwards.
+func (rc *RecordedConn) Close() {
+	rc.closeOnce.Do(func() {
+		close(rc.conn.packetChan)
+	})
+}
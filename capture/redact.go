@@ -0,0 +1,336 @@
+package capture
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/pingcap/tidb/pkg/parser"
+	"github.com/pingcap/tidb/pkg/parser/ast"
+	"github.com/pingcap/tidb/pkg/parser/format"
+	"github.com/pingcap/tidb/pkg/parser/opcode"
+	"github.com/pingcap/tidb/pkg/parser/test_driver"
+)
+
+const (
+	maskRedaction = "mask"
+	hashRedaction = "hash"
+)
+
+// redaction is the policy in effect, nil when queries are written as sent
+var redaction *redactionPolicy
+
+// redactionPolicy rewrites the literals of a query before it is written.
+// Without columns every literal is redacted, otherwise only the values
+// compared with or assigned to a column whose name contains one of them.
+// Masked literals become ?, hashed ones a salted hash of the value so equal
+// values stay equal.
+type redactionPolicy struct {
+	Mode    string   `json:"mode"`
+	Columns []string `json:"columns,omitempty"`
+	salt    []byte
+}
+
+func newRedactionPolicy(mode, salt string, columns []string) (*redactionPolicy, error) {
+	switch mode {
+	case "":
+		if len(columns) == 0 {
+			return nil, nil
+		}
+		mode = maskRedaction
+	case maskRedaction:
+	case hashRedaction:
+		if salt == "" {
+			return nil, fmt.Errorf("hash redaction needs a salt")
+		}
+	default:
+		return nil, fmt.Errorf("unknown redaction %s, use mask or hash", mode)
+	}
+	lowered := make([]string, 0, len(columns))
+	for _, column := range columns {
+		lowered = append(lowered, strings.ToLower(column))
+	}
+	return &redactionPolicy{
+		Mode:    mode,
+		Columns: lowered,
+		salt:    []byte(salt),
+	}, nil
+}
+
+func (p *redactionPolicy) String() string {
+	if len(p.Columns) == 0 {
+		return p.Mode + " all literals"
+	}
+	return fmt.Sprintf("%s %s", p.Mode, strings.Join(p.Columns, ", "))
+}
+
+// redact rewrites the literals of stmt in place. It returns the new text,
+// empty when nothing had to change, and the indexes of the parameters whose
+// bound values must be redacted as well, even when restoring the text fails.
+func (p *redactionPolicy) redact(stmt ast.StmtNode) (string, []int, error) {
+	// passwords are no literals of the tree but plain strings of the
+	// statement, and never worth keeping whatever the policy
+	switch stmt.(type) {
+	case *ast.CreateUserStmt, *ast.AlterUserStmt, *ast.SetPwdStmt, *ast.GrantStmt:
+		return parser.Normalize(stmt.Text(), "ON"), nil, nil
+	}
+	// literals of a DDL are defaults and options, not data
+	if _, ok := stmt.(ast.DDLNode); ok {
+		return "", nil, nil
+	}
+
+	// parameters are numbered in the order they appear in the text, count
+	// them before masked literals turn into markers too
+	markers := &markerVisitor{}
+	stmt.Accept(markers)
+	slices.Sort(markers.offsets)
+
+	r := &redactor{policy: p, params: make(map[int]bool), done: make(map[ast.Node]bool)}
+	if len(p.Columns) == 0 {
+		stmt.Accept(&literalVisitor{r})
+	} else {
+		stmt.Accept(&columnVisitor{r})
+	}
+	var params []int
+	for i, offset := range markers.offsets {
+		if r.params[offset] {
+			params = append(params, i)
+		}
+	}
+
+	if !r.changed {
+		return "", params, nil
+	}
+	var sb strings.Builder
+	err := stmt.Restore(format.NewRestoreCtx(format.DefaultRestoreFlags|format.RestoreStringWithoutCharset, &sb))
+	if err != nil {
+		return "", params, err
+	}
+	return sb.String(), params, nil
+}
+
+// value redacts a bound parameter, which is sent as text whatever its type.
+func (p *redactionPolicy) value(v string) string {
+	if p.Mode == maskRedaction {
+		return "?"
+	}
+	if _, err := strconv.ParseFloat(v, 64); err == nil {
+		return strconv.FormatInt(p.number(v), 10)
+	}
+	return p.hash(v)
+}
+
+// hash returns the salted hash of v as hex, number returns it as an integer
+// so numeric literals stay numeric.
+func (p *redactionPolicy) hash(v string) string {
+	return hex.EncodeToString(p.sum(v)[:8])
+}
+
+func (p *redactionPolicy) number(v string) int64 {
+	return int64(binary.BigEndian.Uint64(p.sum(v)) >> 16)
+}
+
+func (p *redactionPolicy) sum(v string) []byte {
+	mac := hmac.New(sha256.New, p.salt)
+	mac.Write([]byte(v))
+	return mac.Sum(nil)
+}
+
+// redactParams applies the policy to the values bound to an execution.
+func (qr *QueryRecord) redactParams() {
+	for _, i := range qr.redactedParams {
+		if i >= len(qr.Params) || qr.Params[i] == nil {
+			continue
+		}
+		qr.Params[i] = redaction.value(fmt.Sprint(qr.Params[i]))
+	}
+}
+
+type redactor struct {
+	policy *redactionPolicy
+	// params holds the offsets of the parameter markers to redact
+	params map[int]bool
+	// done holds the literals already redacted, so none is hashed twice
+	done    map[ast.Node]bool
+	changed bool
+}
+
+func (r *redactor) matches(column string) bool {
+	column = strings.ToLower(column)
+	for _, c := range r.policy.Columns {
+		if strings.Contains(column, c) {
+			return true
+		}
+	}
+	return false
+}
+
+// sensitive reports whether expr refers to a column matching the policy.
+func (r *redactor) sensitive(expr ast.ExprNode) bool {
+	if expr == nil {
+		return false
+	}
+	v := &sensitiveVisitor{r: r}
+	expr.Accept(v)
+	return v.found
+}
+
+// literals redacts every literal in expr.
+func (r *redactor) literals(expr ast.ExprNode) ast.ExprNode {
+	if expr == nil {
+		return nil
+	}
+	n, _ := expr.Accept(&literalVisitor{r})
+	return n.(ast.ExprNode)
+}
+
+type literalVisitor struct {
+	r *redactor
+}
+
+func (v *literalVisitor) Enter(n ast.Node) (ast.Node, bool) {
+	switch x := n.(type) {
+	case *ast.Limit:
+		// row counts are no data
+		return n, true
+	case *ast.VariableAssignment:
+		// SET NAMES and SET CHARSET take a character set
+		return n, x.Name == ast.SetNames || x.Name == ast.SetCharset
+	}
+	return n, false
+}
+
+func (v *literalVisitor) Leave(n ast.Node) (ast.Node, bool) {
+	switch x := n.(type) {
+	case *test_driver.ParamMarkerExpr:
+		if !v.r.done[n] {
+			v.r.params[x.Offset] = true
+		}
+	case *test_driver.ValueExpr:
+		if v.r.done[n] || x.Kind() == test_driver.KindNull {
+			return n, true
+		}
+		v.r.changed = true
+		var redacted ast.Node
+		if v.r.policy.Mode == maskRedaction {
+			redacted = ast.NewParamMarkerExpr(-1)
+		} else {
+			switch x.Kind() {
+			case test_driver.KindInt64, test_driver.KindUint64, test_driver.KindFloat32,
+				test_driver.KindFloat64, test_driver.KindMysqlDecimal:
+				redacted = ast.NewValueExpr(v.r.policy.number(fmt.Sprint(x.GetValue())), "", "")
+			default:
+				value := fmt.Sprint(x.GetValue())
+				if b, ok := x.GetValue().([]byte); ok {
+					value = string(b)
+				}
+				redacted = ast.NewValueExpr(v.r.policy.hash(value), "", "")
+			}
+		}
+		v.r.done[redacted] = true
+		return redacted, true
+	}
+	return n, true
+}
+
+var comparisons = map[opcode.Op]bool{
+	opcode.EQ:     true,
+	opcode.NE:     true,
+	opcode.LT:     true,
+	opcode.LE:     true,
+	opcode.GT:     true,
+	opcode.GE:     true,
+	opcode.NullEQ: true,
+}
+
+// columnVisitor redacts the values compared with or assigned to a sensitive
+// column.
+type columnVisitor struct {
+	r *redactor
+}
+
+func (v *columnVisitor) Enter(n ast.Node) (ast.Node, bool) {
+	r := v.r
+	switch x := n.(type) {
+	case *ast.BinaryOperationExpr:
+		if !comparisons[x.Op] {
+			break
+		}
+		if r.sensitive(x.L) {
+			x.R = r.literals(x.R)
+		}
+		if r.sensitive(x.R) {
+			x.L = r.literals(x.L)
+		}
+	case *ast.PatternInExpr:
+		if r.sensitive(x.Expr) {
+			for i := range x.List {
+				x.List[i] = r.literals(x.List[i])
+			}
+		}
+	case *ast.PatternLikeOrIlikeExpr:
+		if r.sensitive(x.Expr) {
+			x.Pattern = r.literals(x.Pattern)
+		}
+	case *ast.BetweenExpr:
+		if r.sensitive(x.Expr) {
+			x.Left = r.literals(x.Left)
+			x.Right = r.literals(x.Right)
+		}
+	case *ast.Assignment:
+		if r.matches(x.Column.Name.O) {
+			x.Expr = r.literals(x.Expr)
+		}
+	case *ast.InsertStmt:
+		// without a column list there is no telling which value goes where,
+		// so whole rows are redacted
+		for _, row := range x.Lists {
+			for i := range row {
+				if len(x.Columns) == 0 || (i < len(x.Columns) && r.matches(x.Columns[i].Name.O)) {
+					row[i] = r.literals(row[i])
+				}
+			}
+		}
+	}
+	return n, false
+}
+
+func (v *columnVisitor) Leave(n ast.Node) (ast.Node, bool) {
+	return n, true
+}
+
+type sensitiveVisitor struct {
+	r     *redactor
+	found bool
+}
+
+func (v *sensitiveVisitor) Enter(n ast.Node) (ast.Node, bool) {
+	if c, ok := n.(*ast.ColumnNameExpr); ok && v.r.matches(c.Name.Name.O) {
+		v.found = true
+	}
+	return n, v.found
+}
+
+func (v *sensitiveVisitor) Leave(n ast.Node) (ast.Node, bool) {
+	return n, true
+}
+
+type markerVisitor struct {
+	offsets []int
+}
+
+func (v *markerVisitor) Enter(n ast.Node) (ast.Node, bool) {
+	if m, ok := n.(*test_driver.ParamMarkerExpr); ok {
+		v.offsets = append(v.offsets, m.Offset)
+	}
+	return n, false
+}
+
+func (v *markerVisitor) Leave(n ast.Node) (ast.Node, bool) {
+	return n, true
+}
@@ -0,0 +1,217 @@
+package capture
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/pingcap/tidb/pkg/parser"
+)
+
+func TestRedactionPolicyRedact(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		columns []string
+		query   string
+		// want is empty when the query is left as is
+		want   string
+		params []int
+	}{
+		{
+			name:  "mask every literal",
+			mode:  maskRedaction,
+			query: "select * from t where a = 1 and b = 'x'",
+			want:  "SELECT * FROM `t` WHERE `a`=? AND `b`=?",
+		},
+		{
+			name:  "mask keeps limits and nulls",
+			mode:  maskRedaction,
+			query: "select * from t where a is null and b = 2 limit 10",
+			want:  "SELECT * FROM `t` WHERE `a` IS NULL AND `b`=? LIMIT 10",
+		},
+		{
+			name:   "mask keeps markers and redacts their values",
+			mode:   maskRedaction,
+			query:  "update t set a = ? where id = 7 and b = ?",
+			want:   "UPDATE `t` SET `a`=? WHERE `id`=? AND `b`=?",
+			params: []int{0, 1},
+		},
+		{
+			name:  "mask keeps set names",
+			mode:  maskRedaction,
+			query: "set names 'utf8mb4'",
+			want:  "",
+		},
+		{
+			name:    "columns redact compared values only",
+			mode:    maskRedaction,
+			columns: []string{"email"},
+			query:   "select * from users where email = 'a@b.c' and id = 3",
+			want:    "SELECT * FROM `users` WHERE `email`=? AND `id`=3",
+		},
+		{
+			name:    "columns redact assigned values",
+			mode:    maskRedaction,
+			columns: []string{"secret"},
+			query:   "update t set user_secret = 'p', n = 1 where id = 2",
+			want:    "UPDATE `t` SET `user_secret`=?, `n`=1 WHERE `id`=2",
+		},
+		{
+			name:    "columns redact insert values by position",
+			mode:    maskRedaction,
+			columns: []string{"card"},
+			query:   "insert into t (id, card) values (1, '4111'), (2, ?)",
+			want:    "INSERT INTO `t` (`id`,`card`) VALUES (1,?),(2,?)",
+			params:  []int{0},
+		},
+		{
+			name:    "columns redact in, like and between",
+			mode:    maskRedaction,
+			columns: []string{"name"},
+			query:   "select 1 from t where name in ('a', 'b') or name like 'c%' or name between 'd' and 'e' or id in (1, 2)",
+			want:    "SELECT 1 FROM `t` WHERE `name` IN (?,?) OR `name` LIKE ? OR `name` BETWEEN ? AND ? OR `id` IN (1,2)",
+		},
+		{
+			name:    "columns leave unrelated markers",
+			mode:    maskRedaction,
+			columns: []string{"b"},
+			query:   "select * from t where a = ? and b = ?",
+			want:    "",
+			params:  []int{1},
+		},
+		{
+			name:    "columns leave queries without them alone",
+			mode:    maskRedaction,
+			columns: []string{"email"},
+			query:   "select * from t where id = 3",
+			want:    "",
+		},
+		{
+			name:  "ddl is kept",
+			mode:  maskRedaction,
+			query: "create table t (a int default 1, b varchar(10) default 'x')",
+			want:  "",
+		},
+		{
+			name:    "passwords of create user are masked",
+			mode:    maskRedaction,
+			columns: []string{"email"},
+			query:   "create user 'u'@'%' identified by 'secret'",
+			want:    "create user ? @% identified by ?",
+		},
+		{
+			name:  "passwords of alter user are masked",
+			mode:  hashRedaction,
+			query: "alter user u identified by 'secret'",
+			want:  "alter user `u` identified by ?",
+		},
+		{
+			name:  "passwords of grant are masked",
+			mode:  maskRedaction,
+			query: "grant all on *.* to 'u'@'%' identified by 'supersecret'",
+			want:  "grant all on * . * to ? @% identified by ?",
+		},
+		{
+			name:  "set password is masked",
+			mode:  maskRedaction,
+			query: "set password for u = 'secret'",
+			want:  "set password for `u` = ?",
+		},
+	}
+	p := parser.New()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := newRedactionPolicy(tt.mode, "salt", tt.columns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stmt, err := p.ParseOneStmt(tt.query, "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, params, err := policy.redact(stmt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want || !reflect.DeepEqual(params, tt.params) {
+				t.Errorf("got %q %v, want %q %v", got, params, tt.want, tt.params)
+			}
+		})
+	}
+}
+
+func TestRedactionPolicyHash(t *testing.T) {
+	policy, err := newRedactionPolicy(hashRedaction, "salt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := parser.New().ParseOneStmt("select * from t where a = 'x' or b = 'x' or c = 'y' or d = 42", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := policy.redact(stmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, y := policy.hash("x"), policy.hash("y")
+	if x == y || strings.Count(got, "'"+x+"'") != 2 || !strings.Contains(got, "'"+y+"'") {
+		t.Errorf("got %q, want equal values hashed alike and others apart", got)
+	}
+	if !strings.Contains(got, "`d`="+strconv.FormatInt(policy.number("42"), 10)) {
+		t.Errorf("got %q, want the number hashed to a number", got)
+	}
+	if other, _ := newRedactionPolicy(hashRedaction, "pepper", nil); other.hash("x") == x {
+		t.Errorf("hash of x is the same with another salt")
+	}
+	if policy.value("42") != strconv.FormatInt(policy.number("42"), 10) || policy.value("x") != x {
+		t.Errorf("bound values are hashed unlike literals")
+	}
+}
+
+func TestNewRedactionPolicy(t *testing.T) {
+	tests := []struct {
+		mode    string
+		salt    string
+		columns []string
+		want    *redactionPolicy
+		error   bool
+	}{
+		{mode: "", want: nil},
+		{mode: "", columns: []string{"Email"}, want: &redactionPolicy{Mode: maskRedaction, Columns: []string{"email"}, salt: []byte{}}},
+		{mode: maskRedaction, want: &redactionPolicy{Mode: maskRedaction, Columns: []string{}, salt: []byte{}}},
+		{mode: hashRedaction, salt: "s", want: &redactionPolicy{Mode: hashRedaction, Columns: []string{}, salt: []byte("s")}},
+		{mode: hashRedaction, error: true},
+		{mode: "scramble", error: true},
+	}
+	for _, tt := range tests {
+		got, err := newRedactionPolicy(tt.mode, tt.salt, tt.columns)
+		if tt.error {
+			if err == nil {
+				t.Errorf("%s: got %v, want an error", tt.mode, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %v: got %+v, want %+v", tt.mode, tt.columns, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrorFields(t *testing.T) {
+	err := errors.New(`near "'secret'"`)
+	if got := parseErrorFields("selec 'secret'", err); len(got) != 2 || got[0].String != "selec 'secret'" {
+		t.Errorf("got %v, want the query and the error", got)
+	}
+	redaction = &redactionPolicy{Mode: maskRedaction}
+	defer func() { redaction = nil }()
+	got := parseErrorFields("selec 'secret'", err)
+	if len(got) != 1 || got[0].String != "`selec` ?" {
+		t.Errorf("got %v, want the normalized query only", got)
+	}
+}
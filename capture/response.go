@@ -0,0 +1,167 @@
+package capture
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+type resultState int
+
+const (
+	resultHeader resultState = iota
+	resultColumns
+	resultColumnsEOF
+	resultRows
+)
+
+// result tracks the server reply to the pending query of a conn.
+type result struct {
+	state        resultState
+	columns      uint64
+	affectedRows uint64
+	returnedRows uint64
+	bytes        uint64
+}
+
+func (w *mysqlWire) filterResponse(c *conn, p packet) {
+	for {
+		seq, payload, ok := w.server.next()
+		if !ok {
+			return
+		}
+		if len(payload) == 0 {
+			continue
+		}
+		if seq == 0 && payload[0] == protocolVersion {
+			w.onGreeting(c, payload)
+			continue
+		}
+		if w.handshake {
+			w.onAuthResult(c, payload)
+			continue
+		}
+		if w.preparing != nil {
+			w.onPrepareResponse(c, payload)
+			continue
+		}
+		if c.pending == nil {
+			if w.useDB != "" {
+				w.switchDB(c, payload[0] == okPacket)
+			}
+			continue
+		}
+		c.result.bytes += uint64(len(payload)) + 4
+
+		switch c.result.state {
+		case resultHeader:
+			switch payload[0] {
+			case okPacket:
+				w.onOK(c, payload, p.timestamp)
+			case errPacket:
+				w.onError(c, payload, p.timestamp)
+			case localInfile:
+				// the server answers with OK or ERR once the client has sent the file
+			default:
+				columns, n := readLenEncInt(payload)
+				if n == 0 || columns == 0 {
+					continue
+				}
+				c.result.columns = columns
+				c.result.state = resultColumns
+			}
+		case resultColumns:
+			c.result.columns--
+			if c.result.columns == 0 {
+				c.result.state = resultColumnsEOF
+			}
+		case resultColumnsEOF:
+			c.result.state = resultRows
+			if isEOF(payload) {
+				continue
+			}
+			// CLIENT_DEPRECATE_EOF: rows follow the column definitions directly
+			w.onRow(c, payload, p.timestamp)
+		case resultRows:
+			w.onRow(c, payload, p.timestamp)
+		}
+	}
+}
+
+func (w *mysqlWire) onRow(c *conn, payload []byte, t time.Time) {
+	switch {
+	case payload[0] == errPacket:
+		w.onError(c, payload, t)
+	case payload[0] == eofPacket && len(payload) < maxPacketSize:
+		if isEOF(payload) {
+			w.onStatus(c, binary.LittleEndian.Uint16(payload[3:5]), t)
+			return
+		}
+		w.onOK(c, payload, t)
+	default:
+		c.result.returnedRows++
+	}
+}
+
+func (w *mysqlWire) onOK(c *conn, payload []byte, t time.Time) {
+	data := payload[1:]
+	affectedRows, n := readLenEncInt(data)
+	if n == 0 {
+		w.complete(c, t)
+		c.flushQueued()
+		return
+	}
+	c.result.affectedRows += affectedRows
+	data = data[n:]
+	_, n = readLenEncInt(data)
+	if n == 0 || len(data) < n+2 {
+		w.complete(c, t)
+		c.flushQueued()
+		return
+	}
+	w.onStatus(c, binary.LittleEndian.Uint16(data[n:n+2]), t)
+}
+
+func (w *mysqlWire) onError(c *conn, payload []byte, t time.Time) {
+	if len(payload) >= 3 {
+		c.pending.ErrorCode = binary.LittleEndian.Uint16(payload[1:3])
+	}
+	w.complete(c, t)
+	c.flushQueued()
+}
+
+func (w *mysqlWire) onStatus(c *conn, status uint16, t time.Time) {
+	if status&serverMoreResultsExists == 0 {
+		w.complete(c, t)
+		c.flushQueued()
+		return
+	}
+	// the next result belongs to the next statement of a batch, a CALL
+	// adds its result sets up on the one statement
+	if len(c.queued) > 0 {
+		w.complete(c, t)
+		c.pending, c.queued = c.queued[0], c.queued[1:]
+		c.pending.start = t
+	}
+	c.result.state = resultHeader
+}
+
+// complete applies the schema change of the pending query, if any, before
+// the conn completes it.
+func (w *mysqlWire) complete(c *conn, t time.Time) {
+	if c.pending.use != "" {
+		w.switchDB(c, c.pending.ErrorCode == 0)
+	}
+	c.complete(t)
+}
+
+// complete attaches the response to the pending query and flushes it.
+func (c *conn) complete(t time.Time) {
+	qr := c.pending
+	qr.ResponseTime = t.Sub(qr.start).Microseconds()
+	qr.AffectedRows = c.result.affectedRows
+	qr.ReturnedRows = c.result.returnedRows
+	qr.ResultBytes = c.result.bytes
+	c.pending = nil
+	c.result = result{}
+	qr.flush()
+}
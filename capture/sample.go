@@ -0,0 +1,155 @@
+package capture
+
+import (
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sampling is the policy in effect, nil when every query is kept
+var sampling *sampler
+
+// sampler keeps a slice of the traffic. Whole connections are kept or not by
+// their client address so the order of a session stays intact, statements of
+// a type are kept at random, and each digest is capped at a number of records
+// per second of packet time. The rates are written to the .meta file so that
+// analyze can scale counts back up.
+type sampler struct {
+	// Conn is the percentage of connections kept
+	Conn float64 `json:"conn"`
+	// Types is the percentage of statements kept by type
+	Types map[string]float64 `json:"types,omitempty"`
+	// DigestLimit caps the records of a digest per second
+	DigestLimit int `json:"digest_limit,omitempty"`
+	// Digests holds the digests the cap dropped records of, filled in once
+	// the capture is done
+	Digests map[string]*digestCount `json:"digests,omitempty"`
+
+	mutex  sync.Mutex
+	counts map[string]*digestCount
+	second int64
+	window map[digestSecond]int
+}
+
+// digestSecond keys the records of a digest kept within one second, conns
+// flush out of order so a few seconds are kept open at once
+type digestSecond struct {
+	digest string
+	second int64
+}
+
+const openSeconds = 10
+
+type digestCount struct {
+	Seen int64 `json:"seen"`
+	Kept int64 `json:"kept"`
+}
+
+func newSampler(conn float64, types []string, digestLimit int) (*sampler, error) {
+	if conn <= 0 || conn > 100 {
+		return nil, fmt.Errorf("connection sample rate must be within (0, 100]")
+	}
+	if digestLimit < 0 {
+		return nil, fmt.Errorf("digest sample limit can't be negative")
+	}
+	rates := make(map[string]float64)
+	for _, t := range types {
+		typ, rate, ok := strings.Cut(t, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid type sample rate %s, use type=percent", t)
+		}
+		percent, err := strconv.ParseFloat(rate, 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid type sample rate %s, use type=percent", t)
+		}
+		rates[strings.ToLower(typ)] = percent
+	}
+	if conn == 100 && len(rates) == 0 && digestLimit == 0 {
+		return nil, nil
+	}
+	return &sampler{
+		Conn:        conn,
+		Types:       rates,
+		DigestLimit: digestLimit,
+		counts:      make(map[string]*digestCount),
+		window:      make(map[digestSecond]int),
+	}, nil
+}
+
+// keepConn reports whether the connection of the client address is sampled,
+// the same address always gets the same answer.
+func (s *sampler) keepConn(from string) bool {
+	if s.Conn >= 100 {
+		return true
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(from))
+	return float64(h.Sum32()%10000) < s.Conn*100
+}
+
+// keep reports whether the record is sampled.
+func (s *sampler) keep(qr *QueryRecord) bool {
+	if rate, ok := s.Types[qr.Type]; ok && rand.Float64()*100 >= rate {
+		return false
+	}
+	if s.DigestLimit == 0 {
+		return true
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	second := qr.start.Unix()
+	if second > s.second {
+		s.second = second
+		for key := range s.window {
+			if key.second <= second-openSeconds {
+				delete(s.window, key)
+			}
+		}
+	}
+	count, ok := s.counts[qr.Digest]
+	if !ok {
+		count = &digestCount{}
+		s.counts[qr.Digest] = count
+	}
+	count.Seen++
+	// records of a second already closed count against the oldest open one
+	key := digestSecond{qr.Digest, max(second, s.second-openSeconds+1)}
+	if s.window[key] >= s.DigestLimit {
+		return false
+	}
+	s.window[key]++
+	count.Kept++
+	return true
+}
+
+// finish keeps the counts of the digests that were capped for the .meta file.
+func (s *sampler) finish() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Digests = make(map[string]*digestCount)
+	for digest, count := range s.counts {
+		if count.Seen != count.Kept {
+			s.Digests[digest] = count
+		}
+	}
+}
+
+func (s *sampler) String() string {
+	var rates []string
+	if s.Conn < 100 {
+		rates = append(rates, fmt.Sprintf("%g%% of connections", s.Conn))
+	}
+	for _, typ := range slices.Sorted(maps.Keys(s.Types)) {
+		rates = append(rates, fmt.Sprintf("%g%% of %s", s.Types[typ], typ))
+	}
+	if s.DigestLimit > 0 {
+		rates = append(rates, fmt.Sprintf("%d/s per digest", s.DigestLimit))
+	}
+	return strings.Join(rates, ", ")
+}
@@ -0,0 +1,397 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+const (
+	typeTiny       = 0x01
+	typeShort      = 0x02
+	typeLong       = 0x03
+	typeFloat      = 0x04
+	typeDouble     = 0x05
+	typeNull       = 0x06
+	typeTimestamp  = 0x07
+	typeLongLong   = 0x08
+	typeInt24      = 0x09
+	typeDate       = 0x0a
+	typeTime       = 0x0b
+	typeDatetime   = 0x0c
+	typeYear       = 0x0d
+	typeNewDate    = 0x0e
+	typeTimestamp2 = 0x11
+	typeDatetime2  = 0x12
+	typeTime2      = 0x13
+
+	unsignedParam  = 0x80
+	unsignedColumn = 0x0020
+
+	// parameterCountAvailable flags an execute that carries a parameter
+	// count, query attributes included, though the statement has no params
+	parameterCountAvailable = 0x08
+)
+
+var errMalformedExecute = errors.New("malformed execute packet")
+
+// statement is a server-side prepared statement known to a conn.
+type statement struct {
+	id       uint32
+	query    string
+	params   int
+	types    []paramType
+	longData map[int][]byte
+	// pending parameter definitions of the prepare reply
+	defs int
+}
+
+type paramType struct {
+	tp       byte
+	unsigned bool
+}
+
+// onPrepareResponse consumes the COM_STMT_PREPARE_OK reply and the parameter
+// definitions that follow it.
+func (w *mysqlWire) onPrepareResponse(c *conn, payload []byte) {
+	stmt := w.preparing
+	if stmt.defs > 0 {
+		stmt.types[stmt.params-stmt.defs] = readParamType(payload)
+		stmt.defs--
+		if stmt.defs == 0 {
+			w.preparing = nil
+		}
+		return
+	}
+
+	if payload[0] != okPacket || len(payload) < 12 {
+		w.preparing = nil
+		return
+	}
+	stmt.id = binary.LittleEndian.Uint32(payload[1:5])
+	stmt.params = int(binary.LittleEndian.Uint16(payload[7:9]))
+	stmt.types = make([]paramType, stmt.params)
+	stmt.defs = stmt.params
+	w.stmts[stmt.id] = stmt
+	if stmt.defs == 0 {
+		w.preparing = nil
+	}
+}
+
+// readParamType extracts the type of a column definition packet.
+func readParamType(payload []byte) paramType {
+	data := payload
+	// catalog, schema, table, org_table, name, org_name
+	for i := 0; i < 6; i++ {
+		length, n := readLenEncInt(data)
+		if n == 0 || len(data) < n+int(length) {
+			return paramType{}
+		}
+		data = data[n+int(length):]
+	}
+	// length of fixed fields, charset, column length
+	if len(data) < 10 {
+		return paramType{}
+	}
+	return paramType{
+		tp:       data[7],
+		unsigned: binary.LittleEndian.Uint16(data[8:10])&unsignedColumn != 0,
+	}
+}
+
+func (w *mysqlWire) onSendLongData(c *conn, payload []byte) {
+	if len(payload) < 7 {
+		return
+	}
+	stmt, ok := w.stmts[binary.LittleEndian.Uint32(payload[1:5])]
+	if !ok {
+		return
+	}
+	param := int(binary.LittleEndian.Uint16(payload[5:7]))
+	if stmt.longData == nil {
+		stmt.longData = make(map[int][]byte)
+	}
+	stmt.longData[param] = append(stmt.longData[param], payload[7:]...)
+}
+
+func (w *mysqlWire) onStmtReset(c *conn, payload []byte) {
+	if len(payload) < 5 {
+		return
+	}
+	if stmt, ok := w.stmts[binary.LittleEndian.Uint32(payload[1:5])]; ok {
+		stmt.longData = nil
+	}
+}
+
+func (w *mysqlWire) onStmtClose(c *conn, payload []byte) {
+	if len(payload) < 5 {
+		return
+	}
+	delete(w.stmts, binary.LittleEndian.Uint32(payload[1:5]))
+}
+
+// decodeExecute resolves the statement of a COM_STMT_EXECUTE and decodes its
+// bound values from the binary protocol. With CLIENT_QUERY_ATTRIBUTES the
+// values are preceded by their count and every type is followed by a name,
+// the attributes come after the params and are skipped.
+func (w *mysqlWire) decodeExecute(c *conn, payload []byte) (*statement, []any, error) {
+	if len(payload) < 10 {
+		return nil, nil, errMalformedExecute
+	}
+	id := binary.LittleEndian.Uint32(payload[1:5])
+	stmt, ok := w.stmts[id]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown statement id %d", id)
+	}
+	defer func() {
+		stmt.longData = nil
+	}()
+
+	data := payload[10:]
+	attributes := c.session.Capabilities&clientQueryAttributes != 0
+	count := stmt.params
+	if attributes && (stmt.params > 0 || payload[5]&parameterCountAvailable != 0) {
+		n, size := readLenEncInt(data)
+		if size == 0 || n < uint64(stmt.params) || n > uint64(len(data)) {
+			return nil, nil, errMalformedExecute
+		}
+		count = int(n)
+		data = data[size:]
+	}
+	if stmt.params == 0 {
+		return stmt, nil, nil
+	}
+
+	bitmap := (count + 7) / 8
+	if len(data) < bitmap+1 {
+		return nil, nil, errMalformedExecute
+	}
+	nulls := data[:bitmap]
+	bound := data[bitmap]
+	data = data[bitmap+1:]
+	if bound == 1 {
+		for i := 0; i < count; i++ {
+			if len(data) < 2 {
+				return nil, nil, errMalformedExecute
+			}
+			if i < stmt.params {
+				stmt.types[i] = paramType{
+					tp:       data[0],
+					unsigned: data[1]&unsignedParam != 0,
+				}
+			}
+			data = data[2:]
+			if attributes {
+				var ok bool
+				_, data, ok = readLenEncString(data)
+				if !ok {
+					return nil, nil, errMalformedExecute
+				}
+			}
+		}
+	}
+
+	params := make([]any, stmt.params)
+	for i, t := range stmt.types {
+		if nulls[i/8]&(1<<(i%8)) != 0 {
+			continue
+		}
+		if long, ok := stmt.longData[i]; ok {
+			params[i] = string(long)
+			continue
+		}
+		value, n, err := decodeValue(t, data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decode param %d failed: %w", i, err)
+		}
+		params[i] = value
+		data = data[n:]
+	}
+	return stmt, params, nil
+}
+
+// queryText returns the text of a COM_QUERY. With CLIENT_QUERY_ATTRIBUTES
+// the client sends the attributes of the query in front of it, as a count, a
+// NULL bitmap, typed and named parameters and their values.
+func (c *conn) queryText(payload []byte) ([]byte, error) {
+	data := payload[1:]
+	if c.session.Capabilities&clientQueryAttributes == 0 {
+		return data, nil
+	}
+	malformed := errors.New("malformed query attributes")
+	count, n := readLenEncInt(data)
+	if n == 0 || count > uint64(len(data)) {
+		return nil, malformed
+	}
+	data = data[n:]
+	// the number of parameter sets, always 1
+	_, n = readLenEncInt(data)
+	if n == 0 {
+		return nil, malformed
+	}
+	data = data[n:]
+	if count == 0 {
+		return data, nil
+	}
+
+	bitmap := (int(count) + 7) / 8
+	if len(data) < bitmap+1 {
+		return nil, malformed
+	}
+	nulls := data[:bitmap]
+	data = data[bitmap+1:]
+	types := make([]paramType, count)
+	for i := range types {
+		if len(data) < 2 {
+			return nil, malformed
+		}
+		types[i] = paramType{
+			tp:       data[0],
+			unsigned: data[1]&unsignedParam != 0,
+		}
+		var ok bool
+		_, data, ok = readLenEncString(data[2:])
+		if !ok {
+			return nil, malformed
+		}
+	}
+	for i, t := range types {
+		if nulls[i/8]&(1<<(i%8)) != 0 {
+			continue
+		}
+		_, n, err := decodeValue(t, data)
+		if err != nil {
+			return nil, fmt.Errorf("decode attribute %d failed: %w", i, err)
+		}
+		data = data[n:]
+	}
+	return data, nil
+}
+
+// decodeValue formats a binary protocol value as the literal MySQL would
+// accept in a text query, and returns the number of bytes it occupied.
+func decodeValue(t paramType, data []byte) (any, int, error) {
+	truncated := fmt.Errorf("truncated value of type 0x%02x", t.tp)
+	switch t.tp {
+	case typeNull:
+		return nil, 0, nil
+	case typeTiny:
+		if len(data) < 1 {
+			return nil, 0, truncated
+		}
+		if t.unsigned {
+			return strconv.FormatUint(uint64(data[0]), 10), 1, nil
+		}
+		return strconv.FormatInt(int64(int8(data[0])), 10), 1, nil
+	case typeShort, typeYear:
+		if len(data) < 2 {
+			return nil, 0, truncated
+		}
+		v := binary.LittleEndian.Uint16(data)
+		if t.unsigned {
+			return strconv.FormatUint(uint64(v), 10), 2, nil
+		}
+		return strconv.FormatInt(int64(int16(v)), 10), 2, nil
+	case typeLong, typeInt24:
+		if len(data) < 4 {
+			return nil, 0, truncated
+		}
+		v := binary.LittleEndian.Uint32(data)
+		if t.unsigned {
+			return strconv.FormatUint(uint64(v), 10), 4, nil
+		}
+		return strconv.FormatInt(int64(int32(v)), 10), 4, nil
+	case typeLongLong:
+		if len(data) < 8 {
+			return nil, 0, truncated
+		}
+		v := binary.LittleEndian.Uint64(data)
+		if t.unsigned {
+			return strconv.FormatUint(v, 10), 8, nil
+		}
+		return strconv.FormatInt(int64(v), 10), 8, nil
+	case typeFloat:
+		if len(data) < 4 {
+			return nil, 0, truncated
+		}
+		v := math.Float32frombits(binary.LittleEndian.Uint32(data))
+		return strconv.FormatFloat(float64(v), 'g', -1, 32), 4, nil
+	case typeDouble:
+		if len(data) < 8 {
+			return nil, 0, truncated
+		}
+		v := math.Float64frombits(binary.LittleEndian.Uint64(data))
+		return strconv.FormatFloat(v, 'g', -1, 64), 8, nil
+	case typeDate, typeNewDate, typeDatetime, typeDatetime2, typeTimestamp, typeTimestamp2:
+		return decodeDatetime(t.tp, data)
+	case typeTime, typeTime2:
+		return decodeTime(data)
+	default:
+		// strings, blobs, decimals, json, enum, set, bit and geometry are
+		// all sent as length-encoded strings
+		length, n := readLenEncInt(data)
+		if n == 0 || len(data) < n+int(length) {
+			return nil, 0, truncated
+		}
+		return string(data[n : n+int(length)]), n + int(length), nil
+	}
+}
+
+func decodeDatetime(tp byte, data []byte) (any, int, error) {
+	if len(data) < 1 || len(data) < int(data[0])+1 {
+		return nil, 0, fmt.Errorf("truncated value of type 0x%02x", tp)
+	}
+	length := int(data[0])
+	v := data[1 : length+1]
+	var year, month, day, hour, minute, second int
+	var micro uint32
+	if length >= 4 {
+		year = int(binary.LittleEndian.Uint16(v[0:2]))
+		month, day = int(v[2]), int(v[3])
+	}
+	if length >= 7 {
+		hour, minute, second = int(v[4]), int(v[5]), int(v[6])
+	}
+	if length >= 11 {
+		micro = binary.LittleEndian.Uint32(v[7:11])
+	}
+
+	date := fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+	if tp == typeDate || tp == typeNewDate {
+		return date, length + 1, nil
+	}
+	datetime := fmt.Sprintf("%s %02d:%02d:%02d", date, hour, minute, second)
+	if micro > 0 {
+		datetime += fmt.Sprintf(".%06d", micro)
+	}
+	return datetime, length + 1, nil
+}
+
+func decodeTime(data []byte) (any, int, error) {
+	if len(data) < 1 || len(data) < int(data[0])+1 {
+		return nil, 0, fmt.Errorf("truncated value of type 0x%02x", typeTime)
+	}
+	length := int(data[0])
+	v := data[1 : length+1]
+	var sign string
+	var hours, minute, second int
+	var micro uint32
+	if length >= 8 {
+		if v[0] == 1 {
+			sign = "-"
+		}
+		hours = int(binary.LittleEndian.Uint32(v[1:5]))*24 + int(v[5])
+		minute, second = int(v[6]), int(v[7])
+	}
+	if length >= 12 {
+		micro = binary.LittleEndian.Uint32(v[8:12])
+	}
+
+	t := fmt.Sprintf("%s%02d:%02d:%02d", sign, hours, minute, second)
+	if micro > 0 {
+		t += fmt.Sprintf(".%06d", micro)
+	}
+	return t, length + 1, nil
+}
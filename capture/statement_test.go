@@ -0,0 +1,280 @@
+package capture
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeValue(t *testing.T) {
+	float := make([]byte, 4)
+	binary.LittleEndian.PutUint32(float, math.Float32bits(1.5))
+	double := make([]byte, 8)
+	binary.LittleEndian.PutUint64(double, math.Float64bits(-0.25))
+
+	tests := []struct {
+		name  string
+		t     paramType
+		data  []byte
+		want  any
+		size  int
+		error bool
+	}{
+		{name: "null", t: paramType{tp: typeNull}, data: nil, want: nil, size: 0},
+		{name: "tiny", t: paramType{tp: typeTiny}, data: []byte{0xff}, want: "-1", size: 1},
+		{name: "unsigned tiny", t: paramType{tp: typeTiny, unsigned: true}, data: []byte{0xff}, want: "255", size: 1},
+		{name: "short", t: paramType{tp: typeShort}, data: []byte{0x00, 0x80}, want: "-32768", size: 2},
+		{name: "year", t: paramType{tp: typeYear}, data: []byte{0xea, 0x07}, want: "2026", size: 2},
+		{name: "long", t: paramType{tp: typeLong}, data: []byte{0x2a, 0x00, 0x00, 0x00}, want: "42", size: 4},
+		{name: "unsigned long", t: paramType{tp: typeLong, unsigned: true}, data: []byte{0xff, 0xff, 0xff, 0xff}, want: "4294967295", size: 4},
+		{name: "longlong", t: paramType{tp: typeLongLong}, data: []byte{0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, want: "-2", size: 8},
+		{name: "unsigned longlong", t: paramType{tp: typeLongLong, unsigned: true}, data: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, want: "18446744073709551615", size: 8},
+		{name: "float", t: paramType{tp: typeFloat}, data: float, want: "1.5", size: 4},
+		{name: "double", t: paramType{tp: typeDouble}, data: double, want: "-0.25", size: 8},
+		{name: "date", t: paramType{tp: typeDate}, data: []byte{4, 0xea, 0x07, 10, 17}, want: "2026-10-17", size: 5},
+		{name: "zero datetime", t: paramType{tp: typeDatetime}, data: []byte{0}, want: "0000-00-00 00:00:00", size: 1},
+		{name: "datetime", t: paramType{tp: typeDatetime}, data: []byte{7, 0xea, 0x07, 10, 17, 8, 30, 5}, want: "2026-10-17 08:30:05", size: 8},
+		{
+			name: "timestamp with micros", t: paramType{tp: typeTimestamp},
+			data: []byte{11, 0xea, 0x07, 10, 17, 8, 30, 5, 0x40, 0xe2, 0x01, 0x00},
+			want: "2026-10-17 08:30:05.123456", size: 12,
+		},
+		{name: "time", t: paramType{tp: typeTime}, data: []byte{8, 0, 1, 0, 0, 0, 2, 3, 4}, want: "26:03:04", size: 9},
+		{
+			name: "negative time with micros", t: paramType{tp: typeTime},
+			data: []byte{12, 1, 0, 0, 0, 0, 10, 0, 0, 0x01, 0x00, 0x00, 0x00},
+			want: "-10:00:00.000001", size: 13,
+		},
+		{name: "string", t: paramType{tp: 0xfd}, data: []byte{3, 'a', 'b', 'c', 'd'}, want: "abc", size: 4},
+		{name: "empty string", t: paramType{tp: 0xfe}, data: []byte{0}, want: "", size: 1},
+		{name: "truncated long", t: paramType{tp: typeLong}, data: []byte{0x2a}, error: true},
+		{name: "truncated datetime", t: paramType{tp: typeDatetime}, data: []byte{7, 0xea, 0x07}, error: true},
+		{name: "truncated string", t: paramType{tp: 0xfd}, data: []byte{3, 'a'}, error: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, size, err := decodeValue(tt.t, tt.data)
+			if tt.error {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want || size != tt.size {
+				t.Errorf("got %v of %d bytes, want %v of %d", got, size, tt.want, tt.size)
+			}
+		})
+	}
+}
+
+// executePacket builds a COM_STMT_EXECUTE of statement 1, body follows the
+// flags and the iteration count.
+func executePacket(flags byte, body ...byte) []byte {
+	return append([]byte{0x17, 0x01, 0x00, 0x00, 0x00, flags, 0x01, 0x00, 0x00, 0x00}, body...)
+}
+
+func TestDecodeExecute(t *testing.T) {
+	tests := []struct {
+		name         string
+		capabilities uint32
+		params       int
+		// types are the types the statement was last executed with
+		types    []paramType
+		longData map[int][]byte
+		payload  []byte
+		want     []any
+		error    bool
+	}{
+		{
+			name:    "no params",
+			payload: executePacket(0),
+			want:    nil,
+		},
+		{
+			name:   "types bound",
+			params: 2,
+			payload: executePacket(0,
+				0x00, 0x01,
+				typeLong, 0x00, 0xfd, 0x00,
+				0x2a, 0x00, 0x00, 0x00,
+				0x02, 'h', 'i'),
+			want: []any{"42", "hi"},
+		},
+		{
+			name:   "null bitmap",
+			params: 2,
+			payload: executePacket(0,
+				0x01, 0x01,
+				typeLong, 0x00, typeLong, 0x80,
+				0xff, 0xff, 0xff, 0xff),
+			want: []any{nil, "4294967295"},
+		},
+		{
+			name:   "types of the previous execution",
+			params: 1,
+			types:  []paramType{{tp: typeTiny, unsigned: true}},
+			payload: executePacket(0,
+				0x00, 0x00,
+				0xff),
+			want: []any{"255"},
+		},
+		{
+			name:     "long data",
+			params:   2,
+			longData: map[int][]byte{0: []byte("blob")},
+			payload: executePacket(0,
+				0x00, 0x01,
+				0xfc, 0x00, typeTiny, 0x00,
+				0x07),
+			want: []any{"blob", "7"},
+		},
+		{
+			name:         "query attributes",
+			capabilities: clientQueryAttributes,
+			params:       1,
+			payload: executePacket(parameterCountAvailable,
+				0x02,
+				0x00, 0x01,
+				typeLong, 0x00, 0x00,
+				0xfd, 0x00, 0x02, 'i', 'd',
+				0x2a, 0x00, 0x00, 0x00,
+				0x03, 'a', 'b', 'c'),
+			want: []any{"42"},
+		},
+		{
+			name:         "query attributes without params",
+			capabilities: clientQueryAttributes,
+			payload: executePacket(parameterCountAvailable,
+				0x01,
+				0x00, 0x01,
+				0xfd, 0x00, 0x02, 'i', 'd',
+				0x03, 'a', 'b', 'c'),
+			want: nil,
+		},
+		{
+			name:         "query attributes capability with params only",
+			capabilities: clientQueryAttributes,
+			params:       1,
+			payload: executePacket(0,
+				0x01,
+				0x00, 0x01,
+				typeTiny, 0x00, 0x00,
+				0x05),
+			want: []any{"5"},
+		},
+		{
+			name:         "parameter count below the params",
+			capabilities: clientQueryAttributes,
+			params:       2,
+			payload: executePacket(parameterCountAvailable,
+				0x01,
+				0x00, 0x01,
+				typeTiny, 0x00, 0x00,
+				0x05),
+			error: true,
+		},
+		{
+			name:    "truncated",
+			params:  1,
+			payload: executePacket(0, 0x00, 0x01, typeLong),
+			error:   true,
+		},
+		{
+			name:    "truncated value",
+			params:  1,
+			payload: executePacket(0, 0x00, 0x01, typeLong, 0x00, 0x2a),
+			error:   true,
+		},
+		{
+			name:    "short packet",
+			payload: []byte{0x17, 0x01, 0x00},
+			error:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			types := make([]paramType, tt.params)
+			copy(types, tt.types)
+			w := newMySQLWire(0)
+			w.stmts[1] = &statement{id: 1, query: "select ?", params: tt.params, types: types, longData: tt.longData}
+			c := &conn{session: session{Capabilities: tt.capabilities}}
+			stmt, params, err := w.decodeExecute(c, tt.payload)
+			if tt.error {
+				if err == nil {
+					t.Fatalf("got %v, want an error", params)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stmt.id != 1 || !reflect.DeepEqual(params, tt.want) {
+				t.Errorf("got statement %d with %v, want 1 with %v", stmt.id, params, tt.want)
+			}
+			if stmt.longData != nil {
+				t.Errorf("long data kept after the execution")
+			}
+		})
+	}
+
+	t.Run("unknown statement", func(t *testing.T) {
+		w := newMySQLWire(0)
+		_, _, err := w.decodeExecute(&conn{}, executePacket(0))
+		if err == nil {
+			t.Fatal("got no error for an unknown statement")
+		}
+	})
+}
+
+// columnDef is a column definition packet of a BIGINT column.
+func columnDef(seq byte, name string) []byte {
+	var def []byte
+	for _, s := range []string{"def", "", "", "", name, ""} {
+		def = append(def, byte(len(s)))
+		def = append(def, s...)
+	}
+	def = append(def, 0x0c, 0x3f, 0x00, 0x14, 0x00, 0x00, 0x00, typeLongLong, 0x00, 0x00, 0x00, 0x00, 0x00)
+	return mysqlPacket(seq, def)
+}
+
+func TestCaptureCursorFetch(t *testing.T) {
+	s := newTCPSession(t)
+	s.open()
+	s.request(mysqlPacket(0, []byte("\x16select id from t where a > ?")))
+	s.reply(
+		mysqlPacket(1, []byte{okPacket, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}),
+		columnDef(2, "?"),
+		mysqlPacket(3, []byte{eofPacket, 0x00, 0x00, 0x02, 0x00}),
+		columnDef(4, "id"),
+		mysqlPacket(5, []byte{eofPacket, 0x00, 0x00, 0x02, 0x00}))
+	// CURSOR_TYPE_READ_ONLY, the server answers with the columns only
+	s.request(mysqlPacket(0, executePacket(0x01, 0x00, 0x01, typeLongLong, 0x00, 5, 0, 0, 0, 0, 0, 0, 0)))
+	s.reply(
+		mysqlPacket(1, []byte{0x01}),
+		columnDef(2, "id"),
+		mysqlPacket(3, []byte{eofPacket, 0x00, 0x00, 0x42, 0x00}))
+	// COM_STMT_FETCH of 10 rows gets the last 2
+	s.request(mysqlPacket(0, []byte{0x1c, 0x01, 0x00, 0x00, 0x00, 0x0a, 0x00, 0x00, 0x00}))
+	s.reply(
+		mysqlPacket(1, []byte{0x00, 0x00, 6, 0, 0, 0, 0, 0, 0, 0}),
+		mysqlPacket(2, []byte{0x00, 0x00, 7, 0, 0, 0, 0, 0, 0, 0}),
+		mysqlPacket(3, []byte{eofPacket, 0x00, 0x00, 0x82, 0x00}))
+	s.request(mysqlPacket(0, []byte{0x19, 0x01, 0x00, 0x00, 0x00}))
+	records, letters := s.replay()
+
+	if len(records) != 1 || len(letters) != 0 {
+		t.Fatalf("got %d records and %d dead letters, want the execution only", len(records), len(letters))
+	}
+	r := records[0]
+	if r.Text != "select id from t where a > ?;" || !reflect.DeepEqual(r.Params, []any{"5"}) || r.ReturnedRows != 2 {
+		t.Errorf("got %q with %v and %d rows, want the execution with the fetched rows", r.Text, r.Params, r.ReturnedRows)
+	}
+	// the execution is answered by the rows of its fetch
+	if r.ResponseTime != 3000 {
+		t.Errorf("got response time %dµs, want 3000µs", r.ResponseTime)
+	}
+}
@@ -10,17 +10,40 @@ import (
 )
 
 var (
-	TotalQueryCount      atomic.Int32
-	CurrentConnCount     atomic.Int32
-	TotalCloseConnCount  atomic.Int32
-	TotalLostPacketCount atomic.Int32
-	TotalOutOrderCount   atomic.Int32
-	UnknownCommandCount  atomic.Int32
-	ParseErrorCount      atomic.Int32
+	TotalQueryCount       atomic.Int32
+	CurrentConnCount      atomic.Int32
+	TotalCloseConnCount   atomic.Int32
+	TotalLostPacketCount  atomic.Int32
+	TotalOutOrderCount    atomic.Int32
+	UnknownCommandCount   atomic.Int32
+	ParseErrorCount       atomic.Int32
+	UnknownStatementCount atomic.Int32
+	EncryptedConnCount    atomic.Int32
+	CompressedConnCount   atomic.Int32
+	OversizedQueryCount   atomic.Int32
+	DeadLetterCount       atomic.Int32
+	SampledConnCount      atomic.Int32
+	SampledQueryCount     atomic.Int32
+	// what a live capture dropped at each stage for a full queue: packets
+	// read off the devices, reassembled chunks for a conn, and records for
+	// the tape
+	DroppedPacketCount atomic.Int32
+	DroppedChunkCount  atomic.Int32
+	DroppedRecordCount atomic.Int32
 
 	startTime = time.Now()
 )
 
+// pcapDrops are the packets pcap dropped before they were read, by the kernel
+// for want of buffer space and by the interface.
+type pcapDrops struct {
+	Kernel    int `json:"kernel"`
+	Interface int `json:"interface"`
+}
+
+// pcapStats reports the drops of a live capture, it is nil otherwise.
+var pcapStats func() pcapDrops
+
 func statisticsTimer() {
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
@@ -39,6 +62,16 @@ func printStatistics() {
 	outOrderCount := TotalOutOrderCount.Load()
 	unknownCommandCount := UnknownCommandCount.Load()
 	parseErrorCount := ParseErrorCount.Load()
+	unknownStatementCount := UnknownStatementCount.Load()
+	encryptedConnCount := EncryptedConnCount.Load()
+	compressedConnCount := CompressedConnCount.Load()
+	oversizedQueryCount := OversizedQueryCount.Load()
+	deadLetterCount := DeadLetterCount.Load()
+	sampledConnCount := SampledConnCount.Load()
+	sampledQueryCount := SampledQueryCount.Load()
+	droppedPacketCount := DroppedPacketCount.Load()
+	droppedChunkCount := DroppedChunkCount.Load()
+	droppedRecordCount := DroppedRecordCount.Load()
 
 	var qps float64
 	elapsed := time.Since(startTime).Seconds()
@@ -46,14 +79,31 @@ func printStatistics() {
 		qps = math.Round(float64(queryCount)/elapsed*100) / 100
 	}
 
-	log.Info("",
+	fields := []zap.Field{
 		zap.Int32("queries", queryCount),
-		zap.Int32("currentConn", currentConnCount),
-		zap.Int32("closedConn", closeConnCount),
+		zap.Int32("liveConn", currentConnCount),
+		zap.Int32("reapedConn", closeConnCount),
 		zap.Int32("lost", lostPacketCount),
 		zap.Int32("crossed", outOrderCount),
 		zap.Int32("unknown", unknownCommandCount),
 		zap.Int32("parseError", parseErrorCount),
-		zap.Float64("qps", qps),
-	)
+		zap.Int32("unknownStmt", unknownStatementCount),
+		zap.Int32("ssl", encryptedConnCount),
+		zap.Int32("compressed", compressedConnCount),
+		zap.Int32("oversized", oversizedQueryCount),
+		zap.Int32("deadLetter", deadLetterCount),
+		zap.Int32("sampledConn", sampledConnCount),
+		zap.Int32("sampledQuery", sampledQueryCount),
+		zap.Int32("dropPacket", droppedPacketCount),
+		zap.Int32("dropChunk", droppedChunkCount),
+		zap.Int32("dropRecord", droppedRecordCount),
+	}
+	if pcapStats != nil {
+		drops := pcapStats()
+		fields = append(fields,
+			zap.Int("kernelDrop", drops.Kernel),
+			zap.Int("ifDrop", drops.Interface))
+	}
+	fields = append(fields, zap.Float64("qps", qps))
+	log.Info("", fields...)
 }
@@ -0,0 +1,129 @@
+package capture
+
+import (
+	"bytes"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// stream splits the reassembled bytes of one direction of a connection into
+// MySQL packets.
+type stream struct {
+	buffer *bytes.Buffer
+	// compressed holds compressed packets not unwrapped yet, it is nil
+	// unless the connection uses the compressed protocol
+	compressed *bytes.Buffer
+	// maxSize caps the payload of a logical packet, 0 means no limit
+	maxSize int
+	// partial collects a payload split into several packets because it
+	// is 16 MB or more
+	partial    []byte
+	partialSeq byte
+	splitting  bool
+	// oversized is set while the packets of a payload over maxSize are
+	// dropped, discard is what is left of the packet being dropped
+	oversized bool
+	discard   int
+	lastPart  bool
+}
+
+func newStream(maxSize int) *stream {
+	return &stream{
+		buffer:  &bytes.Buffer{},
+		maxSize: maxSize,
+	}
+}
+
+func (s *stream) push(c *conn, p packet) {
+	if p.lost {
+		// whatever is buffered can't be completed anymore
+		log.Debug("stream gap detected",
+			zap.Int("conn", c.id),
+			zap.Int("router", c.router),
+			zap.Bool("response", p.response),
+		)
+		s.reset()
+	}
+	s.write(p.payload)
+}
+
+func (s *stream) write(payload []byte) {
+	if s.compressed != nil {
+		s.compressed.Write(payload)
+		return
+	}
+	s.buffer.Write(payload)
+}
+
+func (s *stream) reset() {
+	s.buffer.Reset()
+	if s.compressed != nil {
+		s.compressed.Reset()
+	}
+	s.partial = nil
+	s.splitting = false
+	s.oversized = false
+	s.discard = 0
+}
+
+// next pops the next complete MySQL packet off the buffer. Payloads split
+// into several packets are joined and carry the sequence id of the first
+// one. A payload over maxSize is skipped without being buffered and comes
+// back as nil once all of it went by. The payload is only valid until the
+// next write to the stream.
+func (s *stream) next() (byte, []byte, bool) {
+	if s.compressed != nil {
+		if err := s.inflate(); err != nil {
+			log.Debug("unwrap compressed packet failed", zap.Error(err))
+			s.reset()
+			return 0, nil, false
+		}
+	}
+	for {
+		if s.discard > 0 {
+			n := min(s.discard, s.buffer.Len())
+			s.buffer.Next(n)
+			s.discard -= n
+			if s.discard > 0 {
+				return 0, nil, false
+			}
+		}
+		if s.oversized && s.lastPart {
+			s.oversized = false
+			return s.partialSeq, nil, true
+		}
+		data := s.buffer.Bytes()
+		if len(data) < 4 {
+			return 0, nil, false
+		}
+		length := int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+		if !s.splitting && !s.oversized {
+			s.partialSeq = data[3]
+		}
+		if s.oversized || (s.maxSize > 0 && len(s.partial)+length > s.maxSize) {
+			s.oversized = true
+			s.partial = nil
+			s.splitting = false
+			s.buffer.Next(4)
+			s.discard = length
+			s.lastPart = length < maxPacketSize
+			continue
+		}
+		if len(data) < length+4 {
+			return 0, nil, false
+		}
+		payload := s.buffer.Next(4 + length)[4:]
+		if length == maxPacketSize {
+			s.partial = append(s.partial, payload...)
+			s.splitting = true
+			continue
+		}
+		if s.splitting {
+			payload = append(s.partial, payload...)
+			s.partial = nil
+			s.splitting = false
+		}
+		return s.partialSeq, payload, true
+	}
+}
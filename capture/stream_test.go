@@ -0,0 +1,121 @@
+package capture
+
+import (
+	"bytes"
+	"testing"
+)
+
+// mysqlPacket frames payload as a MySQL packet with sequence id seq.
+func mysqlPacket(seq byte, payload []byte) []byte {
+	n := len(payload)
+	return append([]byte{byte(n), byte(n >> 8), byte(n >> 16), seq}, payload...)
+}
+
+func TestStreamNext(t *testing.T) {
+	type popped struct {
+		seq  byte
+		size int
+		// skipped is set for a payload over maxSize
+		skipped bool
+	}
+	large := bytes.Repeat([]byte{'x'}, maxPacketSize)
+	split := append(mysqlPacket(0, large), mysqlPacket(1, []byte("tail"))...)
+
+	tests := []struct {
+		name    string
+		maxSize int
+		// chunks are written one after the other, next is drained after each
+		chunks [][]byte
+		want   []popped
+	}{
+		{
+			name:   "single packet",
+			chunks: [][]byte{mysqlPacket(0, []byte("\x03select 1"))},
+			want:   []popped{{seq: 0, size: 9}},
+		},
+		{
+			name:   "packet split across chunks",
+			chunks: [][]byte{mysqlPacket(0, []byte("\x03select 1"))[:6], mysqlPacket(0, []byte("\x03select 1"))[6:]},
+			want:   []popped{{seq: 0, size: 9}},
+		},
+		{
+			name:   "header split across chunks",
+			chunks: [][]byte{{0x01, 0x00}, {0x00, 0x02, 0x0e}},
+			want:   []popped{{seq: 2, size: 1}},
+		},
+		{
+			name:   "several packets in one chunk",
+			chunks: [][]byte{append(mysqlPacket(0, []byte("\x0e")), mysqlPacket(0, []byte("\x03select 1"))...)},
+			want:   []popped{{seq: 0, size: 1}, {seq: 0, size: 9}},
+		},
+		{
+			name:   "payload split at 16 MB",
+			chunks: [][]byte{split},
+			want:   []popped{{seq: 0, size: maxPacketSize + 4}},
+		},
+		{
+			name:   "payload of exactly 16 MB ends with an empty packet",
+			chunks: [][]byte{append(mysqlPacket(3, large), mysqlPacket(4, nil)...)},
+			want:   []popped{{seq: 3, size: maxPacketSize}},
+		},
+		{
+			name:   "split payload arriving in pieces",
+			chunks: [][]byte{split[:1024], split[1024 : maxPacketSize+2], split[maxPacketSize+2:]},
+			want:   []popped{{seq: 0, size: maxPacketSize + 4}},
+		},
+		{
+			name:    "oversized payload is skipped",
+			maxSize: 8,
+			chunks:  [][]byte{append(mysqlPacket(0, []byte("\x03select 12345")), mysqlPacket(0, []byte("\x0e"))...)},
+			want:    []popped{{seq: 0, skipped: true}, {seq: 0, size: 1}},
+		},
+		{
+			name:    "oversized payload arriving in pieces",
+			maxSize: 8,
+			chunks:  [][]byte{mysqlPacket(0, []byte("\x03select 12345"))[:6], mysqlPacket(0, []byte("\x03select 12345"))[6:], mysqlPacket(0, []byte("\x0e"))},
+			want:    []popped{{seq: 0, skipped: true}, {seq: 0, size: 1}},
+		},
+		{
+			name:    "oversized split payload is skipped once",
+			maxSize: 1024,
+			chunks:  [][]byte{split, mysqlPacket(0, []byte("\x0e"))},
+			want:    []popped{{seq: 0, skipped: true}, {seq: 0, size: 1}},
+		},
+		{
+			name:    "split payload going over the limit in its last part",
+			maxSize: maxPacketSize + 2,
+			chunks:  [][]byte{split, mysqlPacket(0, []byte("\x0e"))},
+			want:    []popped{{seq: 0, skipped: true}, {seq: 0, size: 1}},
+		},
+		{
+			name:    "payload at the limit is kept",
+			maxSize: 9,
+			chunks:  [][]byte{mysqlPacket(0, []byte("\x03select 1"))},
+			want:    []popped{{seq: 0, size: 9}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStream(tt.maxSize)
+			var got []popped
+			for _, chunk := range tt.chunks {
+				s.write(chunk)
+				for {
+					seq, payload, ok := s.next()
+					if !ok {
+						break
+					}
+					got = append(got, popped{seq: seq, size: len(payload), skipped: payload == nil})
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d packets %v, want %d %v", len(got), got, len(tt.want), tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("packet %d: got %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
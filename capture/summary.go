@@ -0,0 +1,128 @@
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jedib0t/go-pretty/table"
+)
+
+const metaSuffix = ".meta"
+
+// summary describes a finished capture. It is written next to the tape so
+// the tape itself stays plain JSON lines.
+type summary struct {
+	Tape             string    `json:"tape"`
+	Segments         []string  `json:"segments"`
+	Start            time.Time `json:"start"`
+	End              time.Time `json:"end"`
+	Duration         string    `json:"duration"`
+	Queries          int       `json:"queries"`
+	Conns            int       `json:"conns"`
+	LostPackets      int32     `json:"lost"`
+	CrossedPackets   int32     `json:"crossed"`
+	UnknownCommands  int32     `json:"unknown"`
+	ParseErrors      int32     `json:"parse_error"`
+	EncryptedConns   int32     `json:"ssl"`
+	CompressedConns  int32     `json:"compressed"`
+	OversizedQueries int32     `json:"oversized"`
+	DeadLetters      int32     `json:"dead_letters"`
+	SampledConns     int32     `json:"sampled_conns"`
+	SampledQueries   int32     `json:"sampled_queries"`
+	DroppedPackets   int32     `json:"dropped_packets"`
+	DroppedChunks    int32     `json:"dropped_chunks"`
+	DroppedRecords   int32     `json:"dropped_records"`
+	TapeSize         int64     `json:"size"`
+	// Pcap holds what pcap itself dropped, only known for live captures
+	Pcap *pcapDrops `json:"pcap,omitempty"`
+	// Redaction is the policy the queries were written with, never the salt
+	Redaction *redactionPolicy `json:"redaction,omitempty"`
+	// Sampling holds the rates the queries were kept at
+	Sampling *sampler `json:"sampling,omitempty"`
+}
+
+func newSummary(start, end time.Time, conns int) (*summary, error) {
+	if sampling != nil {
+		sampling.finish()
+	}
+	var size int64
+	for _, path := range tape.paths() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		size += info.Size()
+	}
+	var drops *pcapDrops
+	if pcapStats != nil {
+		d := pcapStats()
+		drops = &d
+	}
+	return &summary{
+		Tape:             tape.name,
+		Segments:         tape.segments,
+		Start:            start,
+		End:              end,
+		Duration:         end.Sub(start).Round(time.Second).String(),
+		Queries:          writtenQueries,
+		Conns:            conns,
+		LostPackets:      TotalLostPacketCount.Load(),
+		CrossedPackets:   TotalOutOrderCount.Load(),
+		UnknownCommands:  UnknownCommandCount.Load(),
+		ParseErrors:      ParseErrorCount.Load(),
+		EncryptedConns:   EncryptedConnCount.Load(),
+		CompressedConns:  CompressedConnCount.Load(),
+		OversizedQueries: OversizedQueryCount.Load(),
+		DeadLetters:      DeadLetterCount.Load(),
+		SampledConns:     SampledConnCount.Load(),
+		SampledQueries:   SampledQueryCount.Load(),
+		DroppedPackets:   DroppedPacketCount.Load(),
+		DroppedChunks:    DroppedChunkCount.Load(),
+		DroppedRecords:   DroppedRecordCount.Load(),
+		Pcap:             drops,
+		TapeSize:         size,
+		Redaction:        redaction,
+		Sampling:         sampling,
+	}, nil
+}
+
+func (s *summary) print() {
+	tb := table.NewWriter()
+	tb.SetStyle(table.StyleLight)
+	tb.SetTitle("📋 Capture Summary")
+	tb.AppendRows([]table.Row{
+		{"Duration", s.Duration},
+		{"Queries", s.Queries},
+		{"Connections", s.Conns},
+		{"Lost / Crossed", fmt.Sprintf("%d / %d", s.LostPackets, s.CrossedPackets)},
+		{"Unknown / Parse errors", fmt.Sprintf("%d / %d", s.UnknownCommands, s.ParseErrors)},
+		{"Oversized queries", s.OversizedQueries},
+		{"Dead letters", s.DeadLetters},
+		{"Dropped packets / chunks / records", fmt.Sprintf("%d / %d / %d", s.DroppedPackets, s.DroppedChunks, s.DroppedRecords)},
+		{"SSL / Compressed", fmt.Sprintf("%d / %d", s.EncryptedConns, s.CompressedConns)},
+		{"Segments", len(s.Segments)},
+		{"Tape size", fmt.Sprintf("%.3f MB", float64(s.TapeSize)/1024/1024)},
+	})
+	if s.Pcap != nil {
+		tb.AppendRow(table.Row{"Kernel / Interface drops", fmt.Sprintf("%d / %d", s.Pcap.Kernel, s.Pcap.Interface)})
+	}
+	if s.Sampling != nil {
+		tb.AppendRow(table.Row{"Sampling", s.Sampling})
+		tb.AppendRow(table.Row{"Sampled out conns / queries", fmt.Sprintf("%d / %d", s.SampledConns, s.SampledQueries)})
+	}
+	if s.Redaction != nil {
+		tb.AppendRow(table.Row{"Redaction", s.Redaction})
+	}
+	fmt.Println(tb.Render())
+}
+
+func (s *summary) write() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(tape.dir, s.Tape+metaSuffix), append(data, '\n'), 0644)
+}
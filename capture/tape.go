@@ -0,0 +1,311 @@
+package capture
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	tapeName        = "Queries_%s"
+	gzipCompression = "gzip"
+	zstdCompression = "zstd"
+	// recordQueueSize bounds the records waiting to be written
+	recordQueueSize = 16384
+)
+
+var tape *tapeWriter
+
+// the tape is full once either limit is reached, records after that are
+// dropped and tapeFull is closed to stop the capture
+var (
+	queryLimit     int
+	sizeLimit      int64
+	writtenQueries int
+	writtenBytes   int64
+	tapeFull       = make(chan struct{})
+	tapeFullOnce   sync.Once
+)
+
+// tapeWriter writes query records to Queries_<time>.json, or when rotation is
+// enabled to the segments Queries_<time>.0001.json, Queries_<time>.0002.json
+// and so on. Closed segments are compressed in the background. Records are
+// written by a goroutine of its own, the only one touching the files until
+// the tape is closed.
+type tapeWriter struct {
+	dir            string
+	name           string
+	rotateSize     int64
+	rotateInterval time.Duration
+	compression    string
+	file           *os.File
+	buf            *bufio.Writer
+	index          int
+	opened         time.Time
+	size           int64
+	// segments holds the file names of every segment, compressed ones
+	// included, in order
+	segments     []string
+	segmentMutex sync.Mutex
+	wg           sync.WaitGroup
+	records      chan []byte
+	stopped      chan struct{}
+}
+
+// openTape sets the log level and the redaction policy of cfg and creates
+// the tape.
+func openTape(cfg TapeConfig) error {
+	setLevel(cfg.level)
+
+	err := checkLimits(
+		limit{rotateSize, int64(cfg.rotateSize)},
+		limit{rotate, int64(cfg.rotateInterval)})
+	if err != nil {
+		return err
+	}
+	policy, err := newRedactionPolicy(cfg.redact, cfg.redactSalt, cfg.redactColumns)
+	if err != nil {
+		return err
+	}
+	redaction = policy
+
+	err = createWriteBuffer(cfg.outputDir, int64(cfg.rotateSize)*1024*1024, cfg.rotateInterval, cfg.compression)
+	if err != nil {
+		return fmt.Errorf("create writeBuffer failed: %w", err)
+	}
+	return nil
+}
+
+// Tape is the file the queries are written to.
+func Tape() string {
+	return tape.String()
+}
+
+func createWriteBuffer(dir string, rotateSize int64, rotateInterval time.Duration, compression string) error {
+	switch compression {
+	case "", gzipCompression, zstdCompression:
+	default:
+		return fmt.Errorf("unknown compression %s, use gzip or zstd", compression)
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	tape = &tapeWriter{
+		dir:            dir,
+		name:           fmt.Sprintf(tapeName, time.Now().Format("2006-01-02T15:04:05")),
+		rotateSize:     rotateSize,
+		rotateInterval: rotateInterval,
+		compression:    compression,
+		records:        make(chan []byte, recordQueueSize),
+		stopped:        make(chan struct{}),
+	}
+	err = tape.open()
+	if err != nil {
+		return err
+	}
+	go tape.run()
+	return nil
+}
+
+// closeWriteBuffer writes the records still queued and closes the tape,
+// nothing may be flushed to it afterwards.
+func closeWriteBuffer() error {
+	close(tape.records)
+	<-tape.stopped
+	err := tape.closeSegment()
+	tape.wg.Wait()
+	return err
+}
+
+func (w *tapeWriter) rotating() bool {
+	return w.rotateSize > 0 || w.rotateInterval > 0
+}
+
+func (w *tapeWriter) open() error {
+	name := w.name + ".json"
+	if w.rotating() {
+		w.index++
+		name = fmt.Sprintf("%s.%04d.json", w.name, w.index)
+	}
+	f, err := os.Create(filepath.Join(w.dir, name))
+	if err != nil {
+		return err
+	}
+	w.file = f
+	w.buf = bufio.NewWriterSize(f, 256*1024)
+	w.opened = time.Now()
+	w.size = 0
+	w.segmentMutex.Lock()
+	w.segments = append(w.segments, name)
+	w.segmentMutex.Unlock()
+	return nil
+}
+
+// enqueue hands record over to be written. On a live capture a full queue
+// drops it rather than stall the conn.
+func (w *tapeWriter) enqueue(record []byte) {
+	if !lossy {
+		w.records <- record
+		return
+	}
+	select {
+	case w.records <- record:
+	default:
+		DroppedRecordCount.Add(1)
+	}
+}
+
+// run writes the queued records. The buffer is flushed once the queue runs
+// empty, so a burst costs a write per buffer rather than per record.
+func (w *tapeWriter) run() {
+	defer close(w.stopped)
+	for record := range w.records {
+		w.append(record)
+		if len(w.records) > 0 {
+			continue
+		}
+		err := w.buf.Flush()
+		if err != nil {
+			log.Warn("flush failed", zap.Error(err))
+		}
+	}
+}
+
+// append writes record unless the tape is full, and closes tapeFull once a
+// limit is reached.
+func (w *tapeWriter) append(record []byte) {
+	if (queryLimit > 0 && writtenQueries >= queryLimit) ||
+		(sizeLimit > 0 && writtenBytes+int64(len(record)) > sizeLimit) {
+		tapeFullOnce.Do(func() { close(tapeFull) })
+		return
+	}
+	err := w.write(record)
+	if err != nil {
+		log.Warn("write failed", zap.Error(err))
+		return
+	}
+	writtenQueries++
+	writtenBytes += int64(len(record))
+	if writtenQueries == queryLimit || writtenBytes == sizeLimit {
+		tapeFullOnce.Do(func() { close(tapeFull) })
+	}
+}
+
+// write appends a record, starting a new segment first when the current one
+// is full or old enough. A segment always holds at least one record.
+func (w *tapeWriter) write(record []byte) error {
+	if w.rotating() && w.size > 0 &&
+		((w.rotateSize > 0 && w.size+int64(len(record)) > w.rotateSize) ||
+			(w.rotateInterval > 0 && time.Since(w.opened) >= w.rotateInterval)) {
+		err := w.closeSegment()
+		if err != nil {
+			return fmt.Errorf("close segment failed: %w", err)
+		}
+		err = w.open()
+		if err != nil {
+			return fmt.Errorf("open segment failed: %w", err)
+		}
+	}
+	_, err := w.buf.Write(record)
+	if err != nil {
+		return err
+	}
+	w.size += int64(len(record))
+	return nil
+}
+
+func (w *tapeWriter) closeSegment() error {
+	err := w.buf.Flush()
+	if err != nil {
+		return err
+	}
+	err = w.file.Close()
+	if err != nil {
+		return err
+	}
+	if w.compression == "" {
+		return nil
+	}
+	index := len(w.segments) - 1
+	name := w.segments[index]
+	w.wg.Go(func() {
+		compressed, err := compressSegment(filepath.Join(w.dir, name), w.compression)
+		if err != nil {
+			log.Warn("compress segment failed", zap.String("segment", name), zap.Error(err))
+			return
+		}
+		w.segmentMutex.Lock()
+		w.segments[index] = filepath.Base(compressed)
+		w.segmentMutex.Unlock()
+	})
+	return nil
+}
+
+// paths returns the paths of every segment, only valid once the tape is
+// closed.
+func (w *tapeWriter) paths() []string {
+	paths := make([]string, 0, len(w.segments))
+	for _, segment := range w.segments {
+		paths = append(paths, filepath.Join(w.dir, segment))
+	}
+	return paths
+}
+
+func (w *tapeWriter) String() string {
+	if len(w.segments) == 1 {
+		return filepath.Join(w.dir, w.segments[0])
+	}
+	return fmt.Sprintf("%d segments of %s", len(w.segments), filepath.Join(w.dir, w.name))
+}
+
+// compressSegment replaces the file with a .gz or .zst copy of it.
+func compressSegment(path string, compression string) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	compressed := path + ".gz"
+	if compression == zstdCompression {
+		compressed = path + ".zst"
+	}
+	out, err := os.Create(compressed)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	var zw io.WriteCloser
+	if compression == zstdCompression {
+		zw, err = zstd.NewWriter(out)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		zw = gzip.NewWriter(out)
+	}
+	_, err = io.Copy(zw, in)
+	if err != nil {
+		return "", err
+	}
+	err = zw.Close()
+	if err != nil {
+		return "", err
+	}
+	err = out.Close()
+	if err != nil {
+		return "", err
+	}
+	return compressed, os.Remove(path)
+}
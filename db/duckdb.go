@@ -6,27 +6,65 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 )
 
 const (
-	TableName = "queries"
-	ddl       = `CREATE TABLE %s AS
-		SELECT * FROM read_json('%s', auto_detect = false,
+	TableName           = "queries"
+	DeadLetterTableName = "dead_letters"
+	ddl                 = `CREATE TABLE %s AS
+		SELECT *, CAST(1 AS DOUBLE) AS weight FROM read_json(%s, auto_detect = false,
 		COLUMNS = {
-			'timestamp': 'TIMESTAMP_MS', 
+			'timestamp': 'TIMESTAMP_US', 
 			'conn': 'INT', 
+			'seq': 'INT',
+			'batch': 'INT',
+			'client': 'VARCHAR',
+			'server': 'VARCHAR',
+			'protocol': 'VARCHAR',
 			'type': 'VARCHAR(11)', 
+			'subtype': 'VARCHAR',
 			'digest': 'VARCHAR(64)', 
-			'text': 'TEXT'})`
+			'text': 'TEXT',
+			'params': 'VARCHAR[]',
+			'response_time': 'BIGINT',
+			'affected_rows': 'UBIGINT',
+			'returned_rows': 'UBIGINT',
+			'result_bytes': 'UBIGINT',
+			'error_code': 'USMALLINT',
+			'sqlstate': 'VARCHAR',
+			'process_keys': 'UBIGINT',
+			'plan_digest': 'VARCHAR',
+			'user': 'VARCHAR',
+			'db': 'VARCHAR',
+			'charset': 'VARCHAR',
+			'capabilities': 'UINTEGER',
+			'attrs': 'MAP(VARCHAR, VARCHAR)'})`
+	deadLetterDDL = `CREATE TABLE %s AS
+		SELECT * FROM read_json('%s', auto_detect = false,
+		COLUMNS = {
+			'timestamp': 'TIMESTAMP_US',
+			'conn': 'INT',
+			'seq': 'INT',
+			'client': 'VARCHAR',
+			'server': 'VARCHAR',
+			'db': 'VARCHAR',
+			'command': 'VARCHAR',
+			'error': 'VARCHAR',
+			'raw': 'VARCHAR'})`
 )
 
 var dbName string
 
 type DuckDB struct {
 	Conn *sql.DB
+	// DeadLetters is set once the dead letters of the tape are loaded
+	DeadLetters bool
 }
 
-func NewDuckDB(option string, mm bool) (*DuckDB, error) {
+// NewDuckDB loads the tape made of files, segments of a rotated tape are read
+// as one workload whether they are compressed or not.
+func NewDuckDB(files []string, mm bool) (*DuckDB, error) {
 	if mm {
 		dbName = ":memory:"
 	} else {
@@ -43,7 +81,7 @@ func NewDuckDB(option string, mm bool) (*DuckDB, error) {
 		return nil, fmt.Errorf("drop db failed: %w", err)
 	}
 
-	_, err = conn.Exec(fmt.Sprintf(ddl, TableName, option))
+	_, err = conn.Exec(fmt.Sprintf(ddl, TableName, fileList(files)))
 	if err != nil {
 		return nil, fmt.Errorf("create db failed: %w", err)
 	}
@@ -64,6 +102,101 @@ func NewDuckDB(option string, mm bool) (*DuckDB, error) {
 		Conn: conn}, nil
 }
 
+// LoadDeadLetters loads the dead-letter file written next to the tape into
+// the dead_letters table.
+func (d *DuckDB) LoadDeadLetters(file string) error {
+	_, err := d.Conn.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", DeadLetterTableName))
+	if err != nil {
+		return fmt.Errorf("drop dead letters failed: %w", err)
+	}
+	_, err = d.Conn.Exec(fmt.Sprintf(
+		deadLetterDDL, DeadLetterTableName, strings.ReplaceAll(file, "'", "''")))
+	if err != nil {
+		return fmt.Errorf("load dead letters failed: %w", err)
+	}
+	d.DeadLetters = true
+	return nil
+}
+
+// Scale weighs every query by the number of queries it stands for on a
+// sampled tape. conn and types are the percentages kept, digests the ratio of
+// seen to kept queries of each digest capped.
+func (d *DuckDB) Scale(conn float64, types map[string]float64, digests map[string]float64) error {
+	tx, err := d.Conn.Begin()
+	if err != nil {
+		return fmt.Errorf("scale failed: %w", err)
+	}
+	defer tx.Rollback()
+
+	if conn > 0 && conn < 100 {
+		_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET weight = weight * 100 / ?", TableName), conn)
+		if err != nil {
+			return fmt.Errorf("scale connections failed: %w", err)
+		}
+	}
+	for typ, rate := range types {
+		if rate <= 0 || rate >= 100 {
+			continue
+		}
+		_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET weight = weight * 100 / ? WHERE type = ?", TableName), rate, typ)
+		if err != nil {
+			return fmt.Errorf("scale types failed: %w", err)
+		}
+	}
+	for digest, ratio := range digests {
+		_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET weight = weight * ? WHERE digest = ?", TableName), ratio, digest)
+		if err != nil {
+			return fmt.Errorf("scale digests failed: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// KeepProtocol drops the queries captured off another protocol, tapes from
+// before the protocol was recorded hold MySQL only.
+func (d *DuckDB) KeepProtocol(protocol string) error {
+	_, err := d.Conn.Exec(fmt.Sprintf(
+		"DELETE FROM %s WHERE COALESCE(protocol, 'mysql') <> ?", TableName), protocol)
+	if err != nil {
+		return fmt.Errorf("filter protocol failed: %w", err)
+	}
+	return nil
+}
+
+// KeepServers drops the queries that were not sent to one of the servers,
+// given as host:port endpoints.
+func (d *DuckDB) KeepServers(servers []string) error {
+	if len(servers) == 0 {
+		return nil
+	}
+	args := make([]any, 0, len(servers))
+	for _, server := range servers {
+		args = append(args, server)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(servers)), ", ")
+	tables := []string{TableName}
+	if d.DeadLetters {
+		tables = append(tables, DeadLetterTableName)
+	}
+	for _, table := range tables {
+		_, err := d.Conn.Exec(fmt.Sprintf(
+			"DELETE FROM %s WHERE server IS NULL OR server NOT IN (%s)", table, placeholders), args...)
+		if err != nil {
+			return fmt.Errorf("filter servers failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// fileList renders files as a DuckDB list literal.
+func fileList(files []string) string {
+	quoted := make([]string, 0, len(files))
+	for _, file := range files {
+		quoted = append(quoted, "'"+strings.ReplaceAll(file, "'", "''")+"'")
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
 func (d *DuckDB) Close() error {
 	return d.Conn.Close()
 }
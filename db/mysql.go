@@ -13,20 +13,26 @@ type MySQL struct {
 	User     string
 	Password string
 	Database string
+	// MultiStatements lets one Exec run several statements
+	MultiStatements bool
 }
 
-func NewMySQL(host string, port int, user string, password string, database string) *MySQL {
+func NewMySQL(host string, port int, user string, password string, database string, multiStatements bool) *MySQL {
 	return &MySQL{
-		Host:     host,
-		Port:     port,
-		User:     user,
-		Password: password,
-		Database: database,
+		Host:            host,
+		Port:            port,
+		User:            user,
+		Password:        password,
+		Database:        database,
+		MultiStatements: multiStatements,
 	}
 }
 
 func (m *MySQL) Connect() (*sql.DB, error) {
 	url := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", m.User, m.Password, m.Host, m.Port, m.Database)
+	if m.MultiStatements {
+		url += "?multiStatements=true"
+	}
 	db, err := sql.Open("mysql", url)
 	if err != nil {
 		return nil, err
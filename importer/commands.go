@@ -0,0 +1,48 @@
+package importer
+
+import (
+	"fmt"
+	"slices"
+
+	"cassette-tape/capture"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	file          = "file"
+	format        = "format"
+	server        = "server"
+	generalFormat = "general"
+	slowFormat    = "slow"
+	tidbFormat    = "tidb-slow"
+)
+
+var Commands = &cli.Command{
+	Name: "import",
+	Flags: slices.Concat([]cli.Flag{
+		&cli.StringSliceFlag{
+			Name: file, Usage: "log to import, repeat for several, they are read in order",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name: format, Usage: "general for the MySQL general query log, slow for the MySQL slow query log, tidb-slow for the TiDB slow query log",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name: server, Usage: "host:port recorded as the server of every query, logs don't name it",
+		},
+	}, capture.TapeFlags),
+	Action: func(context *cli.Context) error {
+		i, err := newImporter(
+			context.StringSlice(file),
+			context.String(format),
+			context.String(server),
+			capture.NewTapeConfig(context),
+		)
+		if err != nil {
+			return fmt.Errorf("create importer failed: %w", err)
+		}
+		return i.run()
+	},
+}
@@ -0,0 +1,116 @@
+package importer
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"cassette-tape/capture"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+var (
+	// generalLine starts an entry, the time is left out by 5.6 when it has
+	// not changed since the previous entry
+	generalLine = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}T\S+|\d{6}\s+\d{1,2}:\d{2}:\d{2})?\t+\s*(\d+) ([A-Z][A-Za-z ]*?)(?:\t(.*))?$`)
+	connectArgs = regexp.MustCompile(`^(\S*)@(\S*) on (\S*)`)
+)
+
+// generalLog reads the general query log. Every thread id becomes a conn
+// whose user, client and schema follow its Connect and Init DB entries.
+type generalLog struct {
+	importer *importer
+	threads  map[int]*thread
+	time     time.Time
+	entry    *generalEntry
+}
+
+type thread struct {
+	user   string
+	client string
+	db     string
+}
+
+type generalEntry struct {
+	time     time.Time
+	conn     int
+	command  string
+	argument strings.Builder
+}
+
+func newGeneralLog(i *importer) *generalLog {
+	return &generalLog{
+		importer: i,
+		threads:  make(map[int]*thread),
+	}
+}
+
+func (g *generalLog) line(line string) {
+	if header.MatchString(line) {
+		g.flush()
+		return
+	}
+	match := generalLine.FindStringSubmatch(line)
+	if match == nil {
+		// the rest of a statement spanning several lines
+		if g.entry != nil {
+			g.entry.argument.WriteByte('\n')
+			g.entry.argument.WriteString(line)
+		}
+		return
+	}
+	g.flush()
+	if match[1] != "" {
+		t, err := parseTime(match[1])
+		if err != nil {
+			log.Warn("invalid log time", zap.String("time", match[1]), zap.Error(err))
+		} else {
+			g.time = t
+		}
+	}
+	conn, _ := strconv.Atoi(match[2])
+	g.entry = &generalEntry{
+		time:    g.time,
+		conn:    conn,
+		command: match[3],
+	}
+	g.entry.argument.WriteString(match[4])
+}
+
+func (g *generalLog) flush() {
+	e := g.entry
+	if e == nil {
+		return
+	}
+	g.entry = nil
+	argument := e.argument.String()
+	th, ok := g.threads[e.conn]
+	if !ok {
+		// threads connected before the log was switched on
+		th = &thread{}
+		g.threads[e.conn] = th
+	}
+	switch e.command {
+	case "Connect":
+		if match := connectArgs.FindStringSubmatch(argument); match != nil {
+			th.user, th.client, th.db = match[1], match[2], match[3]
+		}
+	case "Init DB":
+		th.db = argument
+	case "Query", "Execute":
+		th.db = g.importer.importer.Import(&capture.Statement{
+			Time:   e.time,
+			Conn:   e.conn,
+			Client: th.client,
+			Server: g.importer.server,
+			User:   th.user,
+			DB:     th.db,
+			Query:  argument,
+		})
+	case "Quit":
+		delete(g.threads, e.conn)
+	}
+}
@@ -0,0 +1,119 @@
+package importer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"cassette-tape/capture"
+)
+
+// header is written by mysqld at the top of its logs and again after every
+// restart
+var header = regexp.MustCompile(`(started with:|^Tcp port: \d+|^Time\s+Id\s+Command\s+Argument)$`)
+
+// importer converts server logs into a tape.
+type importer struct {
+	files    []string
+	format   string
+	server   string
+	importer *capture.Importer
+}
+
+func newImporter(files []string, format string, server string, tape capture.TapeConfig) (*importer, error) {
+
+	switch format {
+	case generalFormat, slowFormat, tidbFormat:
+	default:
+		return nil, fmt.Errorf("unsupported log format %s, use %s, %s or %s", format, generalFormat, slowFormat, tidbFormat)
+	}
+	for _, file := range files {
+		_, err := os.Stat(file)
+		if err != nil {
+			return nil, fmt.Errorf("open log failed: %w", err)
+		}
+	}
+	ci, err := capture.NewImporter(tape)
+	if err != nil {
+		return nil, err
+	}
+	return &importer{
+		files:    files,
+		format:   format,
+		server:   server,
+		importer: ci,
+	}, nil
+}
+
+func (i *importer) run() error {
+	fmt.Println()
+	fmt.Printf("🚀 Starting import of %s log %s\n\n", i.format, strings.Join(i.files, ", "))
+
+	var reader logReader
+	switch i.format {
+	case generalFormat:
+		reader = newGeneralLog(i)
+	case slowFormat:
+		reader = newSlowLog(i, false)
+	case tidbFormat:
+		reader = newSlowLog(i, true)
+	}
+	for _, file := range i.files {
+		err := readLines(file, reader.line)
+		if err != nil {
+			return fmt.Errorf("read log %s failed: %w", file, err)
+		}
+		reader.flush()
+	}
+
+	err := i.importer.Close()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✅ Import completed, queries written to %s\n", capture.Tape())
+	return nil
+}
+
+// logReader turns the lines of a log into statements. Entries may span
+// several lines, flush hands over the last one once the file is done.
+type logReader interface {
+	line(line string)
+	flush()
+}
+
+func readLines(file string, f func(string)) error {
+	fd, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	// statements may be far longer than a bufio.Scanner accepts
+	reader := bufio.NewReader(fd)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			f(strings.TrimRight(line, "\r\n"))
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parseTime reads the timestamps of MySQL logs, RFC 3339 since 5.7 and
+// yymmdd hh:mm:ss in local time before.
+func parseTime(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("060102 15:04:05", strings.Join(strings.Fields(s), " "), time.Local)
+}
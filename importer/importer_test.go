@@ -0,0 +1,115 @@
+package importer
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestMain(m *testing.M) {
+	// records carry local time, and 5.6 logs are written in it
+	time.Local = time.UTC
+	os.Exit(m.Run())
+}
+
+// record holds what the tests check of a tape record.
+type record struct {
+	Timestamp    string `json:"timestamp"`
+	Conn         int    `json:"conn"`
+	Seq          int    `json:"seq"`
+	Batch        int    `json:"batch"`
+	Client       string `json:"client"`
+	Server       string `json:"server"`
+	User         string `json:"user"`
+	DB           string `json:"db"`
+	Type         string `json:"type"`
+	Text         string `json:"text"`
+	Params       []any  `json:"params"`
+	ResponseTime int64  `json:"response_time"`
+	AffectedRows uint64 `json:"affected_rows"`
+	ReturnedRows uint64 `json:"returned_rows"`
+	ResultBytes  uint64 `json:"result_bytes"`
+	ErrorCode    uint16 `json:"error_code"`
+	ProcessKeys  uint64 `json:"process_keys"`
+	PlanDigest   string `json:"plan_digest"`
+}
+
+// importLog runs the import command on file and returns the records of the
+// tape it wrote.
+func importLog(t *testing.T, format string, file string) []record {
+	t.Helper()
+	dir := t.TempDir()
+	app := &cli.App{Commands: []*cli.Command{Commands}}
+	err := app.Run([]string{"cassette-tape", "import", "--file", file, "--format", format, "--server", "db:3306", "--output-dir", dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tapes, err := filepath.Glob(filepath.Join(dir, "Queries_*.json"))
+	if err != nil || len(tapes) != 1 {
+		t.Fatalf("got tapes %v, %v", tapes, err)
+	}
+	data, err := os.ReadFile(tapes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []record
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var r record
+		err = json.Unmarshal([]byte(line), &r)
+		if err != nil {
+			t.Fatalf("decode %s failed: %v", line, err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func checkRecords(t *testing.T, got []record, want []record) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("got %d records, want %d", len(got), len(want))
+	}
+	for i := range min(len(got), len(want)) {
+		if !reflect.DeepEqual(got[i], want[i]) {
+			t.Errorf("record %d:\ngot  %+v\nwant %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestGeneralLog(t *testing.T) {
+	got := importLog(t, generalFormat, "testdata/general.log")
+	checkRecords(t, got, []record{
+		{Timestamp: "2024-01-01 10:00:00.200000", Conn: 8, Seq: 1, Client: "10.0.0.5", Server: "db:3306", User: "root", DB: "shop", Type: "select", Text: "select * from orders\nwhere id = 3;"},
+		{Timestamp: "2024-01-01 10:00:00.400000", Conn: 8, Seq: 2, Client: "10.0.0.5", Server: "db:3306", User: "root", DB: "billing", Type: "update", Text: "update invoices set paid = 1 where id = 9;"},
+		{Timestamp: "2024-01-01 10:00:00.450000", Conn: 9, Seq: 1, Server: "db:3306", Type: "session", Text: "use crm;"},
+		{Timestamp: "2024-01-01 10:00:00.460000", Conn: 9, Seq: 2, Batch: 2, Server: "db:3306", DB: "crm", Type: "select", Text: "select 1;"},
+		{Timestamp: "2024-01-01 10:00:00.460000", Conn: 9, Seq: 3, Batch: 2, Server: "db:3306", DB: "crm", Type: "select", Text: "select name from customers;"},
+		{Timestamp: "2024-01-01 10:00:00.490000", Conn: 8, Seq: 3, Client: "10.0.0.5", Server: "db:3306", User: "root", DB: "billing", Type: "select", Text: "select * from invoices where id = 5;"},
+		{Timestamp: "2024-01-01 11:00:00.000000", Conn: 20, Seq: 1, Client: "web1", Server: "db:3306", User: "app", Type: "insert", Text: "insert into carts values (1);"},
+		{Timestamp: "2024-01-01 11:00:01.000000", Conn: 20, Seq: 2, Client: "web1", Server: "db:3306", User: "app", Type: "select", Text: "select count(*) from carts;"},
+	})
+}
+
+func TestSlowLog(t *testing.T) {
+	got := importLog(t, slowFormat, "testdata/slow.log")
+	checkRecords(t, got, []record{
+		{Timestamp: "2024-01-01 10:00:00.250000", Conn: 12, Seq: 1, Client: "10.0.0.7", Server: "db:3306", User: "app", DB: "shop", Type: "select", Text: "select * from orders\n# a comment\nwhere total > 100;", ResponseTime: 1250000, ReturnedRows: 42},
+		{Timestamp: "2024-01-01 10:00:01.500000", Conn: 13, Seq: 1, Client: "web1", Server: "db:3306", User: "app", DB: "shop", Type: "delete", Text: "delete from carts where age > 30;", ResponseTime: 500000},
+		{Timestamp: "2024-01-01 10:00:03.800000", Conn: 14, Seq: 1, Client: "10.0.0.8", Server: "db:3306", User: "app", DB: "billing", Type: "insert", Text: "insert into invoices values (1);", ResponseTime: 100000, ResultBytes: 60, ErrorCode: 1062},
+		{Timestamp: "2024-01-01 10:00:04.000000", Conn: 14, Seq: 2, Client: "10.0.0.8", Server: "db:3306", User: "app", DB: "billing", Type: "select", Text: "select * from invoices;", ResponseTime: 200000, ReturnedRows: 1},
+	})
+}
+
+func TestTiDBSlowLog(t *testing.T) {
+	got := importLog(t, tidbFormat, "testdata/tidb-slow.log")
+	checkRecords(t, got, []record{
+		{Timestamp: "2019-08-14 01:26:57.960149", Conn: 3086, Seq: 1, Client: "127.0.0.1", Server: "db:3306", User: "root", DB: "test", Type: "insert", Text: "insert into t select * from t;", ResponseTime: 1527627, ProcessKeys: 131072, PlanDigest: "4a2e3a9b2cfe4f7a1d5f0a8e2b7c6d9e0f1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c"},
+		{Timestamp: "2019-08-14 01:26:59.600000", Conn: 3090, Seq: 1, Client: "10.0.0.9", Server: "db:3306", User: "app", DB: "shop", Type: "select", Text: "select * from orders where id = ? and name = ? and note = ?;", Params: []any{"42", "a, \"b\"", nil}, ResponseTime: 500000, ReturnedRows: 3, ErrorCode: 1105, ProcessKeys: 20, PlanDigest: "9f8e7d6c5b4a39281706f5e4d3c2b1a09f8e7d6c5b4a39281706f5e4d3c2b1a0"},
+	})
+}
@@ -0,0 +1,226 @@
+package importer
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"cassette-tape/capture"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+var (
+	userHost     = regexp.MustCompile(`^# User@Host: ([^\[]*)\[[^\]]*\] @ (\S*) ?\[([^\]]*)\]`)
+	threadID     = regexp.MustCompile(`\b(?:Id|Thread_id): +(\d+)`)
+	attribute    = regexp.MustCompile(`(\w+): +(\S+)`)
+	useLine      = regexp.MustCompile("^use `?([^`;]+)`?;$")
+	setTimestamp = regexp.MustCompile(`^SET timestamp=(\d+);$`)
+	timeLine     = regexp.MustCompile(`^# Time: (.+)$`)
+	// arguments are appended by TiDB to the text of prepared statements
+	arguments = regexp.MustCompile(`(?s)^(.*) \[arguments: (.*)\]$`)
+)
+
+// unknownError stands for the error of a statement TiDB logs as failed, it
+// doesn't log which one
+const unknownError = 1105
+
+// slowLog reads the slow query log. mysqld only writes a use line when the
+// schema differs from the one of the previous entry, whatever its thread, so
+// the schema is tracked across the log rather than by conn. TiDB writes the
+// same layout with headers of its own, among them the schema of every entry.
+type slowLog struct {
+	importer *importer
+	tidb     bool
+	db       string
+	time     time.Time
+	entry    *slowEntry
+}
+
+type slowEntry struct {
+	time       time.Time
+	timestamp  int64
+	conn       int
+	user       string
+	client     string
+	attributes map[string]string
+	// query holds the statement lines, a header line after the first of them
+	// is a comment of the statement
+	query []string
+}
+
+func newSlowLog(i *importer, tidb bool) *slowLog {
+	return &slowLog{
+		importer: i,
+		tidb:     tidb,
+	}
+}
+
+func (s *slowLog) line(line string) {
+	if header.MatchString(line) {
+		s.flush()
+		return
+	}
+	if match := timeLine.FindStringSubmatch(line); match != nil {
+		s.flush()
+		t, err := parseTime(strings.TrimSpace(match[1]))
+		if err != nil {
+			log.Warn("invalid log time", zap.String("time", match[1]), zap.Error(err))
+		} else {
+			s.time = t
+		}
+		s.newEntry().time = t
+		return
+	}
+	if match := userHost.FindStringSubmatch(line); match != nil {
+		// 5.6 leaves out the time line when it has not changed
+		if s.entry == nil || s.entry.user != "" || len(s.entry.query) > 0 {
+			s.flush()
+			s.newEntry()
+		}
+		s.entry.user = strings.TrimSpace(match[1])
+		s.entry.client = match[3]
+		if s.entry.client == "" {
+			s.entry.client = match[2]
+		}
+		if id := threadID.FindStringSubmatch(line); id != nil {
+			s.entry.conn, _ = strconv.Atoi(id[1])
+		}
+		return
+	}
+	e := s.entry
+	if e == nil {
+		return
+	}
+	if len(e.query) == 0 {
+		if strings.HasPrefix(line, "# ") {
+			for _, match := range attribute.FindAllStringSubmatch(line, -1) {
+				e.attributes[match[1]] = match[2]
+			}
+			return
+		}
+		if match := useLine.FindStringSubmatch(line); match != nil {
+			s.db = match[1]
+			return
+		}
+		if match := setTimestamp.FindStringSubmatch(line); match != nil {
+			e.timestamp, _ = strconv.ParseInt(match[1], 10, 64)
+			return
+		}
+	}
+	e.query = append(e.query, line)
+}
+
+func (s *slowLog) newEntry() *slowEntry {
+	s.entry = &slowEntry{
+		attributes: make(map[string]string),
+	}
+	return s.entry
+}
+
+func (s *slowLog) flush() {
+	e := s.entry
+	if e == nil {
+		return
+	}
+	s.entry = nil
+	query := strings.TrimSpace(strings.Join(e.query, "\n"))
+	// mysqld ends every statement with a semicolon of its own
+	query = strings.TrimSuffix(query, ";")
+	if query == "" {
+		return
+	}
+
+	queryTime, _ := strconv.ParseFloat(e.attributes["Query_time"], 64)
+	responseTime := time.Duration(queryTime * float64(time.Second))
+	statement := &capture.Statement{
+		Time:         e.start(s.time, responseTime),
+		Conn:         e.conn,
+		Client:       e.client,
+		Server:       s.importer.server,
+		User:         e.user,
+		DB:           s.db,
+		Query:        query,
+		ResponseTime: responseTime,
+		AffectedRows: e.uint("Rows_affected"),
+		ReturnedRows: e.uint("Rows_sent"),
+		ResultBytes:  e.uint("Bytes_sent"),
+		ErrorCode:    uint16(e.uint("Errno")),
+	}
+	if s.tidb {
+		// statements TiDB runs for itself are no part of the workload
+		if e.attributes["Is_internal"] == "true" {
+			return
+		}
+		s.tidbStatement(e, statement)
+	}
+	s.db = s.importer.importer.Import(statement)
+}
+
+// tidbStatement fills in what the headers of the TiDB slow log tell.
+func (s *slowLog) tidbStatement(e *slowEntry, statement *capture.Statement) {
+	statement.Conn = int(e.uint("Conn_ID"))
+	if db, ok := e.attributes["DB"]; ok {
+		statement.DB = db
+	}
+	statement.ReturnedRows = e.uint("Result_rows")
+	if e.attributes["Succ"] == "false" {
+		statement.ErrorCode = unknownError
+	}
+	statement.ProcessKeys = e.uint("Process_keys")
+	statement.PlanDigest = e.attributes["Plan_digest"]
+	if match := arguments.FindStringSubmatch(statement.Query); match != nil {
+		statement.Query = match[1]
+		statement.Params = parseArguments(match[2])
+	}
+}
+
+// parseArguments reads the values TiDB logs for a prepared statement, one
+// alone or several in parentheses, with strings quoted.
+func parseArguments(s string) []any {
+	if strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")") {
+		s = s[1 : len(s)-1]
+	}
+	params := make([]any, 0)
+	for s != "" {
+		if quoted, err := strconv.QuotedPrefix(s); err == nil {
+			value, _ := strconv.Unquote(quoted)
+			params = append(params, value)
+			s = strings.TrimPrefix(s[len(quoted):], ", ")
+			continue
+		}
+		var value string
+		value, s, _ = strings.Cut(s, ", ")
+		if value == "NULL" {
+			params = append(params, nil)
+			continue
+		}
+		params = append(params, value)
+	}
+	return params
+}
+
+// start finds when the statement began: the Start of log_slow_extra, else
+// the time of the entry, written once it ended, else its SET timestamp.
+func (e *slowEntry) start(last time.Time, responseTime time.Duration) time.Time {
+	if start, ok := e.attributes["Start"]; ok {
+		t, err := parseTime(start)
+		if err == nil {
+			return t
+		}
+	}
+	if !e.time.IsZero() {
+		return e.time.Add(-responseTime)
+	}
+	if e.timestamp > 0 {
+		return time.Unix(e.timestamp, 0)
+	}
+	return last.Add(-responseTime)
+}
+
+func (e *slowEntry) uint(name string) uint64 {
+	v, _ := strconv.ParseUint(e.attributes[name], 10, 64)
+	return v
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"cassette-tape/analyze"
 	"cassette-tape/capture"
+	"cassette-tape/importer"
+	"cassette-tape/proxy"
 	"cassette-tape/replay"
 	"os"
 
@@ -19,11 +21,14 @@ func main() {
 			capture.Commands,
 			analyze.Commands,
 			replay.Commands,
+			proxy.Commands,
+			importer.Commands,
 		},
 	}
 
 	err := app.Run(os.Args)
 	if err != nil {
 		log.Error("error occurred", zap.Error(err))
+		os.Exit(1)
 	}
 }
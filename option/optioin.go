@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 
 	"github.com/manifoldco/promptui"
 	"github.com/pingcap/log"
@@ -13,44 +16,66 @@ import (
 type Option struct {
 	Name string
 	Size string
+	// Files are the tape segments making up the workload, in order
+	Files []string
 }
 
 const (
 	kilobyte   = 1024
 	megabyte   = kilobyte * 1024
 	sizeFormat = "%.3f MB"
-	suffix     = ".json"
 )
 
-func new(name string, size int64) Option {
+// tapePattern matches Queries_<time>.json as well as rotated segments like
+// Queries_<time>.0001.json, compressed or not. Segments of one capture share
+// the first group, the second is the index of the segment, which grows past
+// four digits on long captures.
+var tapePattern = regexp.MustCompile(`^(.+?)(?:\.(\d{4,}))?\.json(\.gz|\.zst)?$`)
+
+func new(name string, size int64, files []string) Option {
 	sizeMB := float64(size) / megabyte
+	if len(files) > 1 {
+		name = fmt.Sprintf("%s (%d segments)", name, len(files))
+	}
 	return Option{
-		Name: name,
-		Size: fmt.Sprintf(sizeFormat, sizeMB),
+		Name:  name,
+		Size:  fmt.Sprintf(sizeFormat, sizeMB),
+		Files: files,
 	}
 }
 
-func GetOption() (string, error) {
-	os, err := getAll()
+// GetOption lets the user pick a workload in dir and returns the files it is
+// made of.
+func GetOption(dir string) ([]string, error) {
+	os, err := getAll(dir)
 	if err != nil {
-		return "", fmt.Errorf("get workload failed: %w", err)
+		return nil, fmt.Errorf("get workload failed: %w", err)
 	}
 	i, _, err := newOptionPrompt(os)
 	if err != nil {
-		return "nil", fmt.Errorf("render promptui failed: %w", err)
+		return nil, fmt.Errorf("render promptui failed: %w", err)
 	}
-	return os[i].Name, nil
+	return os[i].Files, nil
+}
+
+// Sidecar returns the path of the file with suffix written next to the tape
+// that file belongs to, e.g. its .meta or .dead file.
+func Sidecar(file string, suffix string) string {
+	name := tapePattern.FindStringSubmatch(filepath.Base(file))[1]
+	return filepath.Join(filepath.Dir(file), name+suffix)
 }
 
-func getAll() ([]Option, error) {
-	entries, err := os.ReadDir(".")
+func getAll(dir string) ([]Option, error) {
+	entries, err := os.ReadDir(dir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read directory: %w", err)
 	}
 
-	var option []Option
+	var names []string
+	sizes := make(map[string]int64)
+	files := make(map[string][]string)
 	for _, entry := range entries {
-		if isJSON(entry) {
+		if !isTape(entry) {
 			continue
 		}
 		info, err := entry.Info()
@@ -59,8 +84,25 @@ func getAll() ([]Option, error) {
 				zap.String("option", entry.Name()), zap.Error(err))
 			continue
 		}
+		name := tapePattern.FindStringSubmatch(entry.Name())[1]
+		if _, ok := files[name]; !ok {
+			names = append(names, name)
+		}
+		sizes[name] += info.Size()
+		files[name] = append(files[name], filepath.Join(dir, entry.Name()))
+	}
+
+	// entries come sorted by name, which puts .10000 before .1001
+	for _, name := range names {
+		slices.SortStableFunc(files[name], func(a, b string) int {
+			return segment(a) - segment(b)
+		})
+	}
+
+	var option []Option
+	for _, name := range names {
 		option = append(option,
-			new(entry.Name(), info.Size()))
+			new(name, sizes[name], files[name]))
 	}
 
 	if len(option) == 0 {
@@ -69,8 +111,14 @@ func getAll() ([]Option, error) {
 	return option, nil
 }
 
-func isJSON(entry os.DirEntry) bool {
-	return entry.IsDir() || filepath.Ext(entry.Name()) != suffix
+// segment is the index of a tape segment, 0 when the tape was not rotated.
+func segment(file string) int {
+	index, _ := strconv.Atoi(tapePattern.FindStringSubmatch(filepath.Base(file))[2])
+	return index
+}
+
+func isTape(entry os.DirEntry) bool {
+	return !entry.IsDir() && tapePattern.MatchString(entry.Name())
 }
 
 func newOptionPrompt(os []Option) (int, string, error) {
@@ -0,0 +1,59 @@
+package replay
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGetAll(t *testing.T) {
+	dir := t.TempDir()
+	names := []string{
+		"Queries_2026-10-17T08:00:00.json",
+		"Queries_2026-10-17T09:00:00.0001.json.gz",
+		"Queries_2026-10-17T09:00:00.0002.json.gz",
+		"Queries_2026-10-17T09:00:00.9999.json.gz",
+		"Queries_2026-10-17T09:00:00.10000.json.gz",
+		"Queries_2026-10-17T09:00:00.10001.json",
+		"Queries_2026-10-17T09:00:00.meta",
+		"notes.txt",
+	}
+	for _, name := range names {
+		err := os.WriteFile(filepath.Join(dir, name), []byte("{}\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	options, err := getAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"Queries_2026-10-17T08:00:00.json"},
+		{
+			"Queries_2026-10-17T09:00:00.0001.json.gz",
+			"Queries_2026-10-17T09:00:00.0002.json.gz",
+			"Queries_2026-10-17T09:00:00.9999.json.gz",
+			"Queries_2026-10-17T09:00:00.10000.json.gz",
+			"Queries_2026-10-17T09:00:00.10001.json",
+		},
+	}
+	if len(options) != len(want) {
+		t.Fatalf("got %d workloads, want %d", len(options), len(want))
+	}
+	for i, o := range options {
+		var got []string
+		for _, file := range o.Files {
+			got = append(got, filepath.Base(file))
+		}
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("workload %s:\ngot  %v\nwant %v", o.Name, got, want[i])
+		}
+	}
+
+	if got := Sidecar(filepath.Join(dir, "Queries_2026-10-17T09:00:00.10000.json.gz"), ".meta"); got != filepath.Join(dir, "Queries_2026-10-17T09:00:00.meta") {
+		t.Errorf("got sidecar %s", got)
+	}
+}
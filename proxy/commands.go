@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+
+	"cassette-tape/capture"
+
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	listen        = "listen"
+	defaultListen = ":3307"
+	upstream      = "upstream"
+	tlsCert       = "tls-cert"
+	tlsKey        = "tls-key"
+	upstreamCA    = "upstream-ca"
+	insecure      = "upstream-insecure"
+)
+
+var Commands = &cli.Command{
+	Name: "proxy",
+	Flags: slices.Concat([]cli.Flag{
+		&cli.StringFlag{
+			Name: listen, Usage: "address clients connect to",
+			Value: defaultListen,
+		},
+		&cli.StringFlag{
+			Name: upstream, Usage: "address of the mysqld connections are forwarded to",
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name: tlsCert, Usage: "certificate presented to clients, enables TLS on the client side",
+		},
+		&cli.StringFlag{
+			Name: tlsKey, Usage: "private key of --tls-cert",
+		},
+		&cli.StringFlag{
+			Name: upstreamCA, Usage: "verify the upstream certificate against this CA instead of the system roots",
+		},
+		&cli.BoolFlag{
+			Name: insecure, Usage: "skip verifying the upstream certificate, open to man-in-the-middle attacks",
+		},
+		capture.MaxQuerySizeFlag,
+	}, capture.TapeFlags),
+	Action: func(context *cli.Context) error {
+		p, err := newProxy(
+			context.String(listen),
+			context.String(upstream),
+			context.String(tlsCert),
+			context.String(tlsKey),
+			context.String(upstreamCA),
+			context.Bool(insecure),
+			capture.NewTapeConfig(context),
+			context.Int(capture.MaxQuerySizeFlag.Name),
+		)
+		if err != nil {
+			return fmt.Errorf("create proxy failed: %w", err)
+		}
+		return p.run()
+	},
+}
@@ -0,0 +1,316 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"cassette-tape/capture"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	clientSSL      = 0x00000800
+	sslRequestSize = 32
+	bufferSize     = 64 * 1024
+)
+
+// proxy forwards MySQL connections to the upstream server and records the
+// bytes flowing both ways, after TLS is terminated, through a
+// capture.Recorder.
+type proxy struct {
+	upstream string
+	// clientTLS is nil unless a certificate was given, clients are then told
+	// the server can't do SSL
+	clientTLS   *tls.Config
+	upstreamTLS *tls.Config
+	listener    net.Listener
+	recorder    *capture.Recorder
+	wg          sync.WaitGroup
+	mutex       sync.Mutex
+	closed      bool
+	conns       map[net.Conn]struct{}
+}
+
+func newProxy(listen string, upstream string, tlsCert string, tlsKey string, upstreamCA string, upstreamInsecure bool,
+	tape capture.TapeConfig, maxQuerySize int) (*proxy, error) {
+
+	p := &proxy{
+		upstream: upstream,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	if (tlsCert == "") != (tlsKey == "") {
+		return nil, fmt.Errorf("--tls-cert and --tls-key go together")
+	}
+	if tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		if err != nil {
+			return nil, fmt.Errorf("load certificate failed: %w", err)
+		}
+		p.clientTLS = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		}
+	}
+	host, _, err := net.SplitHostPort(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream %s: %w", upstream, err)
+	}
+	if upstreamCA != "" && upstreamInsecure {
+		return nil, fmt.Errorf("--upstream-ca and --upstream-insecure exclude each other")
+	}
+	// verified against the system roots unless told otherwise
+	p.upstreamTLS = &tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: upstreamInsecure,
+	}
+	if upstreamCA != "" {
+		pem, err := os.ReadFile(upstreamCA)
+		if err != nil {
+			return nil, fmt.Errorf("read upstream CA failed: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", upstreamCA)
+		}
+		p.upstreamTLS.RootCAs = pool
+	}
+
+	p.listener, err = net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("listen on %s failed: %w", listen, err)
+	}
+	p.recorder, err = capture.NewRecorder(tape, maxQuerySize)
+	if err != nil {
+		_ = p.listener.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *proxy) run() error {
+	fmt.Println()
+	fmt.Printf("🚀 Starting proxy on %s forwarding to %s\n\n", p.listener.Addr(), p.upstream)
+	if p.clientTLS != nil {
+		fmt.Println("🔒 TLS is terminated on the client side")
+		fmt.Println()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		// a second signal kills the process the usual way
+		signal.Stop(signals)
+		fmt.Printf("\n🛑 Received %s, stopping proxy\n", sig)
+		p.stop()
+	}()
+
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			log.Warn("accept failed", zap.Error(err))
+			continue
+		}
+		if !p.track(client) {
+			_ = client.Close()
+			break
+		}
+		p.wg.Go(func() {
+			p.serve(client)
+		})
+	}
+	p.wg.Wait()
+	err := p.recorder.Close()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✅ Proxy stopped, queries written to %s\n", capture.Tape())
+	return nil
+}
+
+// stop closes the listener and every connection in flight.
+func (p *proxy) stop() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+	_ = p.listener.Close()
+	for conn := range p.conns {
+		_ = conn.Close()
+	}
+}
+
+// track registers a connection for stop, it reports false once the proxy is
+// stopping.
+func (p *proxy) track(conn net.Conn) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return false
+	}
+	p.conns[conn] = struct{}{}
+	return true
+}
+
+func (p *proxy) untrack(conn net.Conn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.conns, conn)
+}
+
+func (p *proxy) serve(client net.Conn) {
+	defer p.untrack(client)
+	defer client.Close()
+
+	server, err := net.Dial("tcp", p.upstream)
+	if err != nil {
+		log.Warn("connect upstream failed", zap.String("from", client.RemoteAddr().String()), zap.Error(err))
+		return
+	}
+	if !p.track(server) {
+		_ = server.Close()
+		return
+	}
+	defer p.untrack(server)
+	defer server.Close()
+
+	rc := p.recorder.Open(client.RemoteAddr().String(), server.RemoteAddr().String())
+	defer rc.Close()
+
+	client, server, err = p.handshake(client, server, rc)
+	if err != nil {
+		log.Warn("proxy handshake failed", zap.String("from", client.RemoteAddr().String()), zap.Error(err))
+		return
+	}
+
+	// either side closing ends both directions
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		pipe(server, client, rc.Request)
+		_ = server.Close()
+	})
+	wg.Go(func() {
+		pipe(client, server, rc.Response)
+		_ = client.Close()
+	})
+	wg.Wait()
+}
+
+// handshake forwards the server greeting and the first client packet. The
+// greeting only offers SSL when the proxy has a certificate and the upstream
+// supports it too, a client asking for it gets TLS terminated on both sides.
+// The packets keep their sequence ids since the SSLRequest goes upstream as
+// well. It returns the connections to pipe the rest through.
+func (p *proxy) handshake(client, server net.Conn, rc *capture.RecordedConn) (net.Conn, net.Conn, error) {
+	greeting, err := readPacket(server)
+	if err != nil {
+		return client, server, fmt.Errorf("read greeting failed: %w", err)
+	}
+	offset, ok := capabilityOffset(greeting)
+	if ok {
+		capabilities := binary.LittleEndian.Uint16(greeting[offset:])
+		if p.clientTLS == nil {
+			capabilities &^= clientSSL
+		}
+		binary.LittleEndian.PutUint16(greeting[offset:], capabilities)
+	}
+	rc.Response(greeting, time.Now())
+	_, err = client.Write(greeting)
+	if err != nil {
+		return client, server, err
+	}
+
+	response, err := readPacket(client)
+	if err != nil {
+		return client, server, fmt.Errorf("read handshake response failed: %w", err)
+	}
+	rc.Request(response, time.Now())
+	_, err = server.Write(response)
+	if err != nil {
+		return client, server, err
+	}
+	if len(response) != 4+sslRequestSize || binary.LittleEndian.Uint32(response[4:])&clientSSL == 0 {
+		return client, server, nil
+	}
+
+	upstreamConn := tls.Client(server, p.upstreamTLS)
+	err = upstreamConn.Handshake()
+	if err != nil {
+		return client, server, fmt.Errorf("upstream tls handshake failed: %w", err)
+	}
+	clientConn := tls.Server(client, p.clientTLS)
+	err = clientConn.Handshake()
+	if err != nil {
+		return client, server, fmt.Errorf("client tls handshake failed: %w", err)
+	}
+	return clientConn, upstreamConn, nil
+}
+
+// capabilityOffset finds the lower capability flags of a HandshakeV10
+// greeting, ok is false for anything else, e.g. an error packet.
+func capabilityOffset(greeting []byte) (int, bool) {
+	payload := greeting[4:]
+	if len(payload) == 0 || payload[0] != 10 {
+		return 0, false
+	}
+	version := bytes.IndexByte(payload[1:], 0)
+	if version < 0 {
+		return 0, false
+	}
+	// protocol version, server version, connection id, auth data, filler
+	offset := 4 + 1 + version + 1 + 4 + 8 + 1
+	if len(greeting) < offset+2 {
+		return 0, false
+	}
+	return offset, true
+}
+
+// readPacket reads one MySQL packet with its header.
+func readPacket(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	packet := make([]byte, 4+length)
+	copy(packet, header)
+	_, err = io.ReadFull(r, packet[4:])
+	if err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// pipe copies src to dst, recording every chunk before it is forwarded so a
+// response is never recorded ahead of its request.
+func pipe(dst, src net.Conn, record func([]byte, time.Time)) {
+	buffer := make([]byte, bufferSize)
+	for {
+		n, err := src.Read(buffer)
+		if n > 0 {
+			record(buffer[:n], time.Now())
+			_, werr := dst.Write(buffer[:n])
+			if werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -14,6 +14,10 @@ const (
 	database = "db"
 	readonly = "readonly"
 	memory   = "memory"
+	server   = "server"
+	dir      = "dir"
+	batch    = "batch"
+	unparsed = "unparsed"
 )
 
 var Commands = &cli.Command{
@@ -40,9 +44,22 @@ var Commands = &cli.Command{
 		&cli.BoolFlag{
 			Name: memory, Value: false, Usage: "enables duckdb in-memory mode",
 		},
+		&cli.StringSliceFlag{
+			Name: server, Usage: "only replay queries sent to this host:port, repeat for several servers",
+		},
+		&cli.StringFlag{
+			Name: dir, Value: ".", Usage: "directory to look for tapes in",
+		},
+		&cli.BoolFlag{
+			Name: batch, Usage: "send the statements of a captured multi-statement query as one batch",
+		},
+		&cli.BoolFlag{
+			Name: unparsed, Usage: "also send the queries the parser rejected verbatim, from the dead-letter file, ignored with --readonly",
+		},
 	},
 	Action: func(context *cli.Context) error {
 		replayer, err := newReplayer(
+			context.String(dir),
 			context.String(host),
 			context.Int(port),
 			context.String(user),
@@ -50,6 +67,9 @@ var Commands = &cli.Command{
 			context.String(database),
 			context.Bool(readonly),
 			context.Bool(memory),
+			context.StringSlice(server),
+			context.Bool(batch),
+			context.Bool(unparsed),
 		)
 		if err != nil {
 			return fmt.Errorf("create replayer failed: %w", err)
@@ -3,7 +3,9 @@ package replay
 import (
 	"cassette-tape/db"
 	o "cassette-tape/option"
+	"errors"
 	"fmt"
+	"os"
 	"time"
 
 	_ "github.com/marcboeker/go-duckdb/v2"
@@ -11,15 +13,17 @@ import (
 	"go.uber.org/zap"
 )
 
+const deadLetterSuffix = ".dead"
+
 type replayer struct {
 	wm       *workloadManager
 	duckdb   *db.DuckDB
 	readonly bool
 }
 
-func newReplayer(host string, port int, user, password, database string, readonly, mm bool) (*replayer, error) {
+func newReplayer(dir string, host string, port int, user, password, database string, readonly, mm bool, servers []string, batch, unparsed bool) (*replayer, error) {
 
-	option, err := o.GetOption()
+	option, err := o.GetOption(dir)
 	if err != nil {
 		return nil, fmt.Errorf("get option failed: %w", err)
 	}
@@ -29,16 +33,47 @@ func newReplayer(host string, port int, user, password, database string, readonl
 	if err != nil {
 		return nil, fmt.Errorf("new engine failed: %w", err)
 	}
+	// their type is unknown, so read-only replay leaves rejected queries out
+	if unparsed && !readonly {
+		err = loadDeadLetters(duckdb, option[0])
+		if err != nil {
+			return nil, fmt.Errorf("new engine failed: %w", err)
+		}
+	}
+	// PostgreSQL statements can't be replayed against MySQL
+	err = duckdb.KeepProtocol("mysql")
+	if err != nil {
+		return nil, fmt.Errorf("new engine failed: %w", err)
+	}
+	err = duckdb.KeepServers(servers)
+	if err != nil {
+		return nil, fmt.Errorf("new engine failed: %w", err)
+	}
 	log.Info("new engine completed", zap.Duration("duration", time.Since(startTime)))
 
 	return &replayer{
 		wm: newWorkloadManager(
-			duckdb, db.NewMySQL(host, port, user, password, database), readonly),
+			duckdb, db.NewMySQL(host, port, user, password, database, batch), readonly, batch, unparsed),
 		duckdb:   duckdb,
 		readonly: readonly,
 	}, nil
 }
 
+// loadDeadLetters loads the dead letters of the tape file belongs to, a
+// capture that rejected nothing has none.
+func loadDeadLetters(duckdb *db.DuckDB, file string) error {
+	path := o.Sidecar(file, deadLetterSuffix)
+	_, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Info("no dead letters found", zap.String("path", path))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return duckdb.LoadDeadLetters(path)
+}
+
 func (r *replayer) run() error {
 	return r.wm.run()
 }
@@ -2,8 +2,11 @@ package replay
 
 import (
 	"cassette-tape/db"
+	"context"
+	"database/sql"
 	"fmt"
 	"math"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -19,18 +22,22 @@ type workloadManager struct {
 	duckdb       *db.DuckDB
 	mysql        *db.MySQL
 	readonly     bool
+	batch        bool
+	unparsed     bool
 	wg           sync.WaitGroup
 	totalQueries atomic.Uint64
 	totalErrors  atomic.Uint64
 }
 
-func newWorkloadManager(duckdb *db.DuckDB, mysql *db.MySQL, readonly bool) *workloadManager {
+func newWorkloadManager(duckdb *db.DuckDB, mysql *db.MySQL, readonly, batch, unparsed bool) *workloadManager {
 	return &workloadManager{
 		workload: make(map[string][]workload),
 		wg:       sync.WaitGroup{},
 		duckdb:   duckdb,
 		mysql:    mysql,
 		readonly: readonly,
+		batch:    batch,
+		unparsed: unparsed && duckdb.DeadLetters,
 	}
 }
 
@@ -78,13 +85,39 @@ func (wm *workloadManager) run() error {
 }
 
 func (wm *workloadManager) runWorkload(ws []workload, bar *progressbar.ProgressBar) error {
-	c, err := wm.mysql.Connect()
+	pool, err := wm.mysql.Connect()
+	if err != nil {
+		return fmt.Errorf("connect mysql failed: %w", err)
+	}
+	defer pool.Close()
+
+	// a single session keeps the schema switches of the captured connection
+	ctx := context.Background()
+	c, err := pool.Conn(ctx)
 	if err != nil {
 		return fmt.Errorf("connect mysql failed: %w", err)
 	}
 	defer c.Close()
+
+	currentDB := wm.mysql.Database
 	for _, w := range ws {
-		_, err := c.Exec(w.text)
+		if w.db != "" && w.db != currentDB {
+			_, err := c.ExecContext(ctx, fmt.Sprintf("USE `%s`", strings.ReplaceAll(w.db, "`", "``")))
+			if err != nil {
+				fmt.Print("\r\033[K")
+				log.Warn("switch database failed",
+					zap.String("db", w.db),
+					zap.String("reason", err.Error()),
+				)
+				err := bar.RenderBlank()
+				if err != nil {
+					return err
+				}
+			} else {
+				currentDB = w.db
+			}
+		}
+		_, err := c.ExecContext(ctx, w.text, w.params...)
 		if err != nil {
 			wm.totalErrors.Add(1)
 			fmt.Print("\r\033[K")
@@ -107,33 +140,58 @@ func (wm *workloadManager) runWorkload(ws []workload, bar *progressbar.ProgressB
 }
 
 func (wm *workloadManager) addWorkload() error {
-	rs, err := wm.duckdb.Conn.Query(`SELECT conn FROM queries GROUP BY conn ORDER BY conn`)
+	conns := `SELECT conn FROM queries GROUP BY conn ORDER BY conn`
+	query := `SELECT timestamp, conn, type, digest, text, params, db, COALESCE(batch, 0), seq FROM queries WHERE conn = ?`
+	if wm.readonly {
+		query += ` AND type = 'select'`
+	}
+	// rejected queries keep their seq, so they are sent in their place
+	if wm.unparsed {
+		conns = `SELECT conn FROM queries UNION SELECT conn FROM dead_letters WHERE command = '0x03' ORDER BY conn`
+		query += ` UNION ALL SELECT timestamp, conn, 'unparsed', '', decode(from_base64(raw))[2:], NULL, db, 0, seq
+			FROM dead_letters WHERE conn = ? AND command = '0x03' AND raw IS NOT NULL`
+	}
+	query += ` ORDER BY timestamp, seq`
+
+	rs, err := wm.duckdb.Conn.Query(conns)
 	if err != nil {
 		return fmt.Errorf("scan conns failed: %w", err)
 	}
 	defer rs.Close()
 
-	query := `SELECT * FROM queries WHERE conn = ? ORDER BY timestamp`
-
 	for rs.Next() {
 		var c string
 		if err := rs.Scan(&c); err != nil {
 			return fmt.Errorf("scan conn failed: %w", err)
 		}
 
-		if wm.readonly {
-			query = `SELECT * FROM queries WHERE conn = ? AND type = 'select' ORDER BY timestamp`
+		args := []any{c}
+		if wm.unparsed {
+			args = append(args, c)
 		}
-		rs, err := wm.duckdb.Conn.Query(query, c)
+		rs, err := wm.duckdb.Conn.Query(query, args...)
 		if err != nil {
 			return fmt.Errorf("scan workload from conn failed: %w", err)
 		}
 		for rs.Next() {
 			var w workload
-			if err := rs.Scan(&w.timestamp, &w.conn, &w.tp, &w.digest, &w.text); err != nil {
+			var params any
+			var db sql.NullString
+			if err := rs.Scan(&w.timestamp, &w.conn, &w.tp, &w.digest, &w.text, &params, &db, &w.batch, &w.seq); err != nil {
 				return fmt.Errorf("scan workload failed: %w", err)
 			}
-			wm.workload[c] = append(wm.workload[c], w)
+			// executions of prepared statements carry their bound values
+			if ps, ok := params.([]any); ok {
+				w.params = ps
+			}
+			w.db = db.String
+			ws := wm.workload[c]
+			// statements of one multi-statement query are sent together
+			if wm.batch && w.batch != 0 && len(ws) > 0 && ws[len(ws)-1].batch == w.batch {
+				ws[len(ws)-1].text += " " + w.text
+				continue
+			}
+			wm.workload[c] = append(ws, w)
 		}
 		log.Info("load workload completed",
 			zap.String("thread", c),
@@ -157,6 +215,10 @@ type workload struct {
 	tp        string
 	digest    string
 	text      string
+	params    []any
+	db        string
+	batch     int
+	seq       int
 }
 
 func confirm(label string) (bool, error) {